@@ -0,0 +1,236 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// incompressibleTypes are content types which are already compressed, such as movie
+// posters. Gzipping them again costs CPU and usually makes them slightly bigger.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/pdf",
+}
+
+// gzipWriters reuses gzip.Writers, which allocate several hundred kilobytes of
+// compression state each, between responses.
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// compress gzips response bodies for clients which accept it. Bodies smaller than
+// -compression-min-size are sent as they are, since compressing them saves little and
+// can make them bigger.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Whether or not this response is compressed, the same URL can produce a
+		// compressed response for another request, so caches must key on the header.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !app.config.compression.enabled || r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, minSize: app.config.compression.minSize}
+
+		// If the handler panics the response is abandoned, so there's nothing to
+		// finish off.
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// compressWriter holds back the start of a response until it knows whether the response
+// is worth compressing: either minSize bytes have been written, or the handler is done.
+type compressWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	// Informational responses, such as 103 Early Hints, go straight through.
+	if status < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends whatever has been written so far. A response which is flushed before
+// reaching minSize is probably being streamed, so it's compressed if it's eligible.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if err := cw.start(true); err != nil {
+			return
+		}
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// start writes the header and the buffered body, compressing from here on if allowed
+// and the response is eligible.
+func (cw *compressWriter) start(allowed bool) error {
+	cw.decided = true
+
+	h := cw.Header()
+
+	// Go sniffs the content type of the first bytes written if the handler hasn't set
+	// one. Once they're compressed that would go wrong, so do it here instead.
+	if _, ok := h["Content-Type"]; !ok && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if allowed && compressible(cw.status, h) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+
+		// A strong ETag promises byte-for-byte identical bodies, which the compressed
+		// body isn't.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		cw.gz = gzipWriters.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.gz != nil {
+		_, err := cw.gz.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// close finishes the response once the handler has returned. A body which never reached
+// minSize is sent uncompressed.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// The handler wrote nothing at all, so let net/http send its implicit 200.
+			return
+		}
+		cw.start(false)
+	}
+
+	if cw.gz != nil {
+		cw.gz.Close()
+		gzipWriters.Put(cw.gz)
+		cw.gz = nil
+	}
+}
+
+// compressible reports whether a response with the given status and headers can be
+// gzipped.
+func compressible(status int, h http.Header) bool {
+	switch {
+	case status == http.StatusNoContent || status == http.StatusNotModified:
+		return false
+	case h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "":
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows a gzipped response. An
+// explicit gzip entry takes priority over "*", and a q-value of 0 rules an encoding out.
+func acceptsGzip(header string) bool {
+	wildcard := false
+
+	for _, entry := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(name) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch coding {
+		case "gzip", "x-gzip":
+			return q > 0
+		case "*":
+			wildcard = q > 0
+		}
+	}
+
+	return wildcard
+}
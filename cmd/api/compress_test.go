@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.enabled = true
+	app.config.compression.minSize = 1024
+
+	large := strings.Repeat(`{"title": "Casablanca"}`, 100)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		wantGzip       bool
+	}{
+		{"large JSON", "gzip, deflate, br", "application/json", large, true},
+		{"small JSON", "gzip", "application/json", `{"status": "available"}`, false},
+		{"not accepted", "", "application/json", large, false},
+		{"refused", "gzip;q=0, *", "application/json", large, false},
+		{"wildcard", "*", "application/json", large, true},
+		{"poster", "gzip", "image/jpeg", large, false},
+		{"sniffed", "gzip", "", large, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(http.StatusCreated)
+				// Write in two parts, so the threshold is crossed mid-response.
+				io.WriteString(w, tt.body[:len(tt.body)/2])
+				io.WriteString(w, tt.body[len(tt.body)/2:])
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+
+			app.compress(next).ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusCreated {
+				t.Errorf("status = %d; want %d", rr.Code, http.StatusCreated)
+			}
+			if !slices.Contains(rr.Header().Values("Vary"), "Accept-Encoding") {
+				t.Errorf("Vary = %q; want it to include Accept-Encoding", rr.Header().Values("Vary"))
+			}
+			if tt.contentType == "" && rr.Header().Get("Content-Type") == "" {
+				t.Error("Content-Type wasn't sniffed")
+			}
+
+			body := rr.Body.String()
+			if tt.wantGzip {
+				if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+					t.Fatalf("Content-Encoding = %q; want gzip", got)
+				}
+				zr, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			} else if got := rr.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q; want none", got)
+			}
+
+			if body != tt.body {
+				t.Errorf("body doesn't match what the handler wrote")
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"GZIP":                 true,
+		"x-gzip":               true,
+		"deflate, br":          false,
+		"br;q=1.0, gzip;q=0.8": true,
+		"gzip;q=0":             false,
+		"gzip; q=0.000":        false,
+		"*":                    true,
+		"*;q=0":                false,
+		"*;q=0, gzip":          true,
+		"identity, *;q=0.5":    true,
+		"gzip;q=0, *":          false,
+	}
+
+	for header, want := range tests {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v; want %v", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"backend.delmesia/internal/data"
+)
+
+// contextKey is a custom type for request context keys, so they can't collide with keys
+// set by other packages.
+type contextKey string
+
+const (
+	userContextKey       = contextKey("user")
+	apiKeyContextKey     = contextKey("apiKey")
+	sessionIDContextKey  = contextKey("sessionID")
+	membershipContextKey = contextKey("membership")
+	requestIDContextKey  = contextKey("requestID")
+	routeContextKey      = contextKey("route")
+	rateLimitContextKey  = contextKey("rateLimit")
+	clientIPContextKey   = contextKey("clientIP")
+)
+
+// contextSetUser returns a new copy of the request with the provided User struct added
+// to the context.
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser retrieves the User struct from the request context. The only time this
+// is used is when we logically expect there to be a User struct value in the context,
+// so if it doesn't exist it is an 'unexpected' error and we panic.
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
+
+// contextSetAPIKey records the API key a request was authenticated with.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key a request was authenticated with, or nil if it
+// wasn't authenticated with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// contextSetSessionID records the ID of the authentication token a request was made
+// with.
+func (app *application) contextSetSessionID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetSessionID returns the ID of the authentication token a request was made
+// with, or 0 if it wasn't made with one (for example when using a JWT or API key).
+func (app *application) contextGetSessionID(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionIDContextKey).(int64)
+	return id
+}
+
+// contextSetRequestID records the ID assigned to a request by requestID().
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns the request's ID, or "" if it doesn't have one.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// contextSetRoute adds the matchedRoute which the router fills in for instrument().
+func (app *application) contextSetRoute(r *http.Request, route *matchedRoute) *http.Request {
+	ctx := context.WithValue(r.Context(), routeContextKey, route)
+	return r.WithContext(ctx)
+}
+
+// contextSetMembership records the organization a request is acting on, and the user's
+// role in it.
+func (app *application) contextSetMembership(r *http.Request, membership *data.Membership) *http.Request {
+	ctx := context.WithValue(r.Context(), membershipContextKey, membership)
+	return r.WithContext(ctx)
+}
+
+// contextGetMembership retrieves the membership set by requireOrganization(). Like
+// contextGetUser(), it panics if there isn't one, since that means a handler has been
+// routed without the middleware.
+func (app *application) contextGetMembership(r *http.Request) *data.Membership {
+	membership, ok := r.Context().Value(membershipContextKey).(*data.Membership)
+	if !ok {
+		panic("missing membership value in request context")
+	}
+
+	return membership
+}
+
+// contextSetRateLimit records the per-IP rate limit decision for a request, so that
+// rateLimit() can tell which limit is closer to running out.
+func (app *application) contextSetRateLimit(r *http.Request, decision rateLimitDecision) *http.Request {
+	ctx := context.WithValue(r.Context(), rateLimitContextKey, decision)
+	return r.WithContext(ctx)
+}
+
+// contextGetRateLimit retrieves the decision set by rateLimitIP(), if there is one.
+func (app *application) contextGetRateLimit(r *http.Request) (rateLimitDecision, bool) {
+	decision, ok := r.Context().Value(rateLimitContextKey).(rateLimitDecision)
+	return decision, ok
+}
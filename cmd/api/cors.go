@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Headers that browser clients may send on cross-origin requests, and response headers
+// they may read, beyond the handful the CORS spec always allows.
+var (
+	corsAllowedHeaders = []string{"Authorization", "Content-Type", "X-Organization-ID", "traceparent", "tracestate"}
+	corsExposedHeaders = []string{"Content-Location", "Location", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"}
+)
+
+// corsPreflightMaxAge is how long, in seconds, browsers may cache a preflight response.
+const corsPreflightMaxAge = 600
+
+// enableCORS allows browser applications served from -cors-trusted-origins to call the
+// API. Requests from other origins are processed as normal, but without the headers
+// which would let the browser hand the response to the calling script.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Origin header even when it's missing or untrusted,
+		// so caches must always take it into account.
+		w.Header().Add("Vary", "Origin")
+
+		if origin := r.Header.Get("Origin"); origin != "" && app.trustedOrigin(origin) {
+			if app.config.cors.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Origin", app.allowedOrigin(origin))
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflightHandler answers CORS preflight requests. It's installed as httprouter's
+// GlobalOPTIONS handler, which is only called for paths that have routes, after the
+// router has set the Allow header to the methods registered for the path.
+func (app *application) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+
+	// A plain OPTIONS request, or a preflight from an untrusted origin, just gets the
+	// Allow header.
+	if origin == "" || method == "" || !app.trustedOrigin(origin) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", w.Header().Get("Allow"))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsPreflightMaxAge))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isPreflight reports whether r is a CORS preflight request, which browsers send on
+// their own before a cross-origin request rather than on the calling script's behalf.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// trustedOrigin reports whether origin is one of -cors-trusted-origins. An entry of "*"
+// trusts every origin.
+func (app *application) trustedOrigin(origin string) bool {
+	return slices.Contains(app.config.cors.trustedOrigins, origin) || slices.Contains(app.config.cors.trustedOrigins, "*")
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a trusted origin. The
+// origin is echoed back, except for the wildcard configuration, which doesn't need to
+// vary by origin.
+func (app *application) allowedOrigin(origin string) string {
+	if slices.Contains(app.config.cors.trustedOrigins, "*") {
+		return "*"
+	}
+	return origin
+}
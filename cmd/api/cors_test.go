@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.cors.trustedOrigins = []string{"https://app.greenlight.example"}
+	app.config.cors.allowCredentials = true
+
+	routes := app.routes()
+
+	tests := []struct {
+		name            string
+		method          string
+		origin          string
+		requestMethod   string
+		wantStatus      int
+		wantAllowOrigin string
+		wantMethods     []string
+	}{
+		{"simple request", http.MethodGet, "https://app.greenlight.example", "", http.StatusOK, "https://app.greenlight.example", nil},
+		{"untrusted origin", http.MethodGet, "https://evil.example", "", http.StatusOK, "", nil},
+		{"no origin", http.MethodGet, "", "", http.StatusOK, "", nil},
+		{"preflight", http.MethodOptions, "https://app.greenlight.example", http.MethodGet, http.StatusNoContent, "https://app.greenlight.example", []string{"GET", "OPTIONS"}},
+		{"untrusted preflight", http.MethodOptions, "https://evil.example", http.MethodPost, http.StatusNoContent, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/healthcheck", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			rr := httptest.NewRecorder()
+
+			routes.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if !slices.Contains(rr.Header().Values("Vary"), "Origin") {
+				t.Errorf("Vary = %q; want it to include Origin", rr.Header().Values("Vary"))
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q; want %q", got, tt.wantAllowOrigin)
+			}
+
+			wantCredentials := ""
+			if tt.wantAllowOrigin != "" {
+				wantCredentials = "true"
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Credentials"); got != wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q; want %q", got, wantCredentials)
+			}
+
+			methods := rr.Header().Get("Access-Control-Allow-Methods")
+			for _, method := range tt.wantMethods {
+				if !strings.Contains(methods, method) {
+					t.Errorf("Access-Control-Allow-Methods = %q; want it to include %s", methods, method)
+				}
+			}
+			if tt.wantMethods == nil && methods != "" {
+				t.Errorf("unexpected Access-Control-Allow-Methods %q", methods)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"backend.delmesia/internal/data"
+)
+
+// stubDB is a minimal database/sql driver for tests which need to get past the models.
+// Each query is answered by the first stubbed result whose match string it contains;
+// anything else returns no rows, which the models report as ErrRecordNotFound. Every
+// statement is remembered, so tests can check what was run.
+type stubDB struct {
+	mu         sync.Mutex
+	results    []stubResult
+	statements []string
+}
+
+// stubResult gives the rows returned by queries containing match.
+type stubResult struct {
+	match string
+	rows  [][]driver.Value
+}
+
+// withStubDB gives app models backed by a stubDB answering with results.
+func withStubDB(t *testing.T, app *application, results ...stubResult) *stubDB {
+	t.Helper()
+
+	stub := &stubDB{results: results}
+	db := sql.OpenDB(stub)
+	t.Cleanup(func() { db.Close() })
+
+	app.models = data.NewModels(db)
+	return stub
+}
+
+// ran reports whether a statement containing s has been run.
+func (stub *stubDB) ran(s string) bool {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	for _, query := range stub.statements {
+		if strings.Contains(query, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (stub *stubDB) record(query string) [][]driver.Value {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	stub.statements = append(stub.statements, query)
+	for _, result := range stub.results {
+		if strings.Contains(query, result.match) {
+			return result.rows
+		}
+	}
+	return nil
+}
+
+func (stub *stubDB) Connect(context.Context) (driver.Conn, error) { return stubConn{stub}, nil }
+func (stub *stubDB) Driver() driver.Driver                        { return nil }
+
+type stubConn struct{ stub *stubDB }
+
+func (c stubConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("stubDB: prepared statements are not supported")
+}
+func (c stubConn) Close() error              { return nil }
+func (c stubConn) Begin() (driver.Tx, error) { return stubTx{}, nil }
+
+func (c stubConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.stub.record(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c stubConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	return &stubRows{values: c.stub.record(query)}, nil
+}
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubRows struct{ values [][]driver.Value }
+
+// Columns only needs to have the right length, which database/sql checks against the
+// destinations passed to Scan().
+func (r *stubRows) Columns() []string {
+	if len(r.values) == 0 {
+		return nil
+	}
+	return make([]string, len(r.values[0]))
+}
+
+func (r *stubRows) Close() error { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
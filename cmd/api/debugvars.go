@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// publishDebugVars adds the application's variables to the map served at /debug/vars.
+// The map belongs to the application rather than expvar's global namespace, where
+// publishing a name twice panics, so each application can have its own.
+func (app *application) publishDebugVars(db *sql.DB) {
+	vars := &app.metrics.debugVars
+
+	versionVar := new(expvar.String)
+	versionVar.Set(version)
+	vars.Set("version", versionVar)
+
+	vars.Set("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+
+	vars.Set("memstats", expvar.Func(func() any {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats
+	}))
+
+	vars.Set("database", expvar.Func(func() any {
+		return db.Stats()
+	}))
+
+	vars.Set("timestamp", expvar.Func(func() any {
+		return time.Now().Unix()
+	}))
+
+	vars.Set("total_requests_received", &app.metrics.requestsReceived)
+	vars.Set("total_responses_sent", &app.metrics.responsesSent)
+	vars.Set("total_responses_sent_by_status", &app.metrics.responsesByStatus)
+}
+
+// debugVarsHandler serves the variables added by publishDebugVars() as a JSON object,
+// like expvar.Handler(). Unlike expvar.Handler() it doesn't include "cmdline", since the
+// command line can hold secrets such as the -db-dsn and -smtp-password flags.
+func (app *application) debugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, app.metrics.debugVars.String())
+}
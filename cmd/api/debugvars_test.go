@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugVars(t *testing.T) {
+	app := newTestApplication(t)
+
+	// sql.Open() doesn't connect, so the pool stats are available without a database.
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	app.publishDebugVars(db)
+
+	routes := app.routes()
+	routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil))
+	routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/unknown", nil))
+
+	rr := httptest.NewRecorder()
+	app.adminRoutes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+
+	var vars struct {
+		Version         string         `json:"version"`
+		Goroutines      int            `json:"goroutines"`
+		Database        sql.DBStats    `json:"database"`
+		Requests        int            `json:"total_requests_received"`
+		Responses       int            `json:"total_responses_sent"`
+		ResponsesStatus map[string]int `json:"total_responses_sent_by_status"`
+		Cmdline         []string       `json:"cmdline"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, rr.Body.String())
+	}
+
+	if vars.Version != version {
+		t.Errorf("version = %q; want %q", vars.Version, version)
+	}
+	if vars.Goroutines == 0 {
+		t.Error("goroutines is missing")
+	}
+	if vars.Requests != 2 || vars.Responses != 2 {
+		t.Errorf("requests = %d, responses = %d; want 2 and 2", vars.Requests, vars.Responses)
+	}
+	if vars.ResponsesStatus["200"] != 1 || vars.ResponsesStatus["404"] != 1 {
+		t.Errorf("responses by status = %v; want one 200 and one 404", vars.ResponsesStatus)
+	}
+	if vars.Cmdline != nil {
+		t.Error("cmdline must not be published")
+	}
+
+	// On the API port, anonymous users can't read them.
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("API port status = %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestDebugVarsPerApplication(t *testing.T) {
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Publishing for a second application mustn't panic, as expvar.Publish() would, and
+	// each application keeps its own counts.
+	first, second := newTestApplication(t), newTestApplication(t)
+	first.publishDebugVars(db)
+	second.publishDebugVars(db)
+
+	first.routes().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil))
+
+	rr := httptest.NewRecorder()
+	second.adminRoutes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+
+	var vars struct {
+		Requests int `json:"total_requests_received"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, rr.Body.String())
+	}
+	if vars.Requests != 0 {
+		t.Errorf("second application's requests = %d; want 0", vars.Requests)
+	}
+}
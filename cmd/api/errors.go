@@ -2,20 +2,48 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"backend.delmesia/internal/data"
 )
 
-// logError method is a generic helper for logging an error message.:
+// logError method is a generic helper for logging an error message, along with the
+// request it happened during.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.Println(err)
+	app.requestLogger(r).Error(err.Error(), "method", r.Method, "uri", r.URL.RequestURI())
 }
 
 // errorResponse method is a generic helper for sending JSON-formatted error messages to the client
 // with a given status code. using the type "any" instead of string can give more flexibility to what
 // values we can include in the response
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
+	app.writeError(w, r, status, app.errorEnvelope(r, status, message))
+}
+
+// errorEnvelope builds the body of an error response, for helpers which need to add
+// fields of their own before sending it with writeError().
+func (app *application) errorEnvelope(r *http.Request, status int, message any) envelope {
 	env := envelope{"error": message}
 
+	// Including the request ID lets a client quote it when reporting a problem, so it
+	// can be matched up with the logs.
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+
+	// Server errors also carry the trace ID, which leads straight to the failing span.
+	if id := traceID(r); id != "" && status >= http.StatusInternalServerError {
+		env["trace_id"] = id
+	}
+
+	return env
+}
+
+// writeError sends an error envelope with the given status code.
+func (app *application) writeError(w http.ResponseWriter, r *http.Request, status int, env envelope) {
 	// Write the response using the writeJSON helper(). If it retursn an error, log it,
 	// and fall back to sending  the client an empty response with a
 	// 500 internal server error status code.
@@ -52,3 +80,132 @@ func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
+
+func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// invalidAuthenticationTokenResponse includes a WWW-Authenticate header to remind the
+// client that a bearer token is expected.
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// invalidAPIKeyResponse is used for API keys which are unknown, expired or used from an
+// address outside their allowlist. The client isn't told which.
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// twoFactorRequiredResponse tells the client that the email and password were correct
+// but the account also needs a totp_code (or recovery_code) to sign in.
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	env := app.errorEnvelope(r, http.StatusUnauthorized, "a two-factor authentication code is required")
+	env["two_factor_required"] = true
+
+	app.writeError(w, r, http.StatusUnauthorized, env)
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must be activated to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// apiKeyNotAllowedResponse is sent when an API key is used for a route which manages the
+// account, rather than the catalog.
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// notMovieOwnerResponse is sent when a contributor tries to change a movie they didn't
+// create.
+func (app *application) notMovieOwnerResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you can only change movies that you created"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) notOrganizationAdminResponse(w http.ResponseWriter, r *http.Request) {
+	message := "only the organization's owners and admins can do this"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) notOrganizationMemberResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you are not a member of this organization"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// noOrganizationResponse is sent when the user doesn't belong to any organization, so
+// there's no catalog for the request to act on.
+func (app *application) noOrganizationResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you are not a member of any organization"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// organizationRequiredResponse is sent when the user belongs to several organizations
+// and the request didn't say which one it is for.
+func (app *application) organizationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must choose an organization with the X-Organization-ID header"
+	app.errorResponse(w, r, http.StatusBadRequest, message)
+}
+
+// tooManyLoginAttemptsResponse is sent while a client is backing off or locked out
+// after failed logins. Retry-After is rounded up to whole seconds.
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// rateLimitExceededResponse is sent when a client has used up its request allowance.
+// Retry-After is rounded up to whole seconds.
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// duplicateMovieResponse sends a 409 Conflict listing the existing movies that look like
+// the one being created, with a link to each, so the client can decide whether to reuse
+// one of them or retry with ?force=true.
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, candidates []*data.Movie) {
+	matches := make([]envelope, 0, len(candidates))
+	for _, movie := range candidates {
+		matches = append(matches, envelope{
+			"id":    movie.ID,
+			"title": movie.Title,
+			"year":  movie.Year,
+			"href":  fmt.Sprintf("/v1/movies/%d", movie.ID),
+		})
+	}
+
+	message := "a movie with the same title and year already exists; resend with ?force=true if this is a different film"
+	env := app.errorEnvelope(r, http.StatusConflict, message)
+	env["candidates"] = matches
+
+	app.writeError(w, r, http.StatusConflict, env)
+}
@@ -6,13 +6,23 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
+	"backend.delmesia/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readInt64Param(r, "id")
+}
+
+// readInt64Param reads a positive integer URL parameter, such as the :session_id in
+// /v1/admin/users/:id/sessions/:session_id.
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
 	// ByName will get the value of ID paramater from the slice.
@@ -20,9 +30,9 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	// (with a bit of size 64). If the paramater couldn't be converted, or is less than 1,
 	// the ID is invalid so return by using http.NotFound() function to return a 404 Not Found response.
 
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 	return id, nil
 }
@@ -107,3 +117,57 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	}
 	return nil
 }
+
+// readBool returns a boolean value from the query string, or the provided default value
+// if no matching key could be found. If the value couldn't be parsed, an error is
+// recorded in the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a multi-byte character.
+// Invalid UTF-8, which PostgreSQL refuses to store as text, is replaced first, since
+// headers such as User-Agent can contain any bytes the client likes.
+func truncateUTF8(s string, n int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if len(s) <= n {
+		return s
+	}
+
+	// Step back from the cut to the start of the character it falls in.
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// background runs fn in a new goroutine, so that slow work such as sending an email
+// doesn't hold up the response. recoverPanic() can't see panics in other goroutines, and
+// an unrecovered one would crash the whole server, so they're recovered and logged here.
+// The goroutine is tracked in app.wg, so shutdown can wait for it to finish.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprintf("panic in background task: %v", err), "stack", string(debug.Stack()))
+			}
+		}()
+
+		fn()
+	}()
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"unicode/utf8"
 )
 
 func healthcheckHandlerMarshalIndent(w http.ResponseWriter, r *http.Request) {
@@ -60,3 +61,29 @@ func BenchmarkMarshal(b *testing.B) {
 		healthcheckHandlerMarshal(w, r)
 	}
 }
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"Mozilla/5.0", 512, "Mozilla/5.0"},
+		{"Mozilla/5.0", 7, "Mozilla"},
+		{"café", 5, "café"},
+		{"café", 4, "caf"}, // "é" is two bytes, and isn't split
+		{"日本語", 4, "日"},
+		{"bad\xffbyte", 512, "bad�byte"},
+		{"", 10, ""},
+	}
+
+	for _, tt := range tests {
+		got := truncateUTF8(tt.s, tt.n)
+		if got != tt.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q; want %q", tt.s, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncateUTF8(%q, %d) returned invalid UTF-8", tt.s, tt.n)
+		}
+	}
+}
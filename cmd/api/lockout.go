@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend.delmesia/internal/data"
+	"backend.delmesia/internal/validator"
+)
+
+// Failed logins are counted separately per account and per client address, so that
+// guessing one account's password from many addresses and guessing many accounts'
+// passwords from one address are both slowed down.
+func accountLoginKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// deleteExpiredLoginFailures clears out failure counts which have expired every
+// interval, until done is closed. It's meant to be run in its own goroutine.
+func (app *application) deleteExpiredLoginFailures(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := app.models.LoginFailures.DeleteExpired(app.config.login.window)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// loginAttempt holds the failure counts for a login attempt, including the attempt
+// itself, which startLoginAttempt() counts before the password is checked.
+type loginAttempt struct {
+	email   string
+	account *data.LoginFailures
+	ip      *data.LoginFailures
+}
+
+// startLoginAttempt counts a login attempt for email against both the account and the
+// client address. If either is locked out or backing off, nothing is counted and it
+// returns how long the client must wait instead.
+func (app *application) startLoginAttempt(r *http.Request, email string) (*loginAttempt, time.Duration, error) {
+	cfg := app.config.login
+	attempt := &loginAttempt{email: email}
+
+	account, ok, err := app.models.LoginFailures.Attempt(accountLoginKey(email), cfg.window, cfg.backoffBase, cfg.backoffMax)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, loginWait(account, cfg.backoffBase, cfg.backoffMax), nil
+	}
+	attempt.account = account
+
+	ip, ok, err := app.models.LoginFailures.Attempt(ipLoginKey(clientIP(r)), cfg.window, cfg.backoffBase, cfg.backoffMax)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		// The account's count has already gone up, so take it back.
+		err = app.models.LoginFailures.Refund(accountLoginKey(email))
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, loginWait(ip, cfg.backoffBase, cfg.backoffMax), nil
+	}
+	attempt.ip = ip
+
+	return attempt, 0, nil
+}
+
+// loginWait is how long a refused attempt must wait. The database decided the attempt
+// was too soon, so it's at least a second even if the clocks disagree.
+func loginWait(f *data.LoginFailures, base, limit time.Duration) time.Duration {
+	return max(f.RetryAfter(time.Now(), base, limit), time.Second)
+}
+
+// refundLoginAttempt takes back an attempt whose password was correct. The account
+// forgets its failures, as the owner has proved who they are, but the client address
+// keeps the failures it had before.
+func (app *application) refundLoginAttempt(r *http.Request, attempt *loginAttempt) error {
+	err := app.models.LoginFailures.Reset(accountLoginKey(attempt.email))
+	if err != nil {
+		return err
+	}
+
+	return app.models.LoginFailures.Refund(ipLoginKey(clientIP(r)))
+}
+
+// recordLoginFailure handles a failed login whose attempt has already been counted by
+// startLoginAttempt(), locking the account or client address if it has now reached its
+// threshold. user is nil if no account exists for the email address, in which case the
+// address is still tracked so that probing for accounts is throttled in the same way.
+//
+// When the account becomes locked the event is audited and, if the account exists, the
+// owner is sent an email containing a token to unlock it.
+func (app *application) recordLoginFailure(r *http.Request, attempt *loginAttempt, user *data.User) error {
+	cfg := app.config.login
+	ip := clientIP(r)
+
+	if attempt.account.Failures >= cfg.accountThreshold {
+		err := app.models.LoginFailures.Lock(accountLoginKey(attempt.email), attempt.account.LastFailureAt.Add(cfg.lockoutDuration))
+		if err != nil {
+			return err
+		}
+
+		event := &data.AuditEvent{
+			Event:   data.AuditAccountLocked,
+			IP:      ip,
+			Details: fmt.Sprintf("email=%s", attempt.email),
+		}
+		if user != nil {
+			event.UserID = user.ID
+		}
+
+		err = app.models.Audit.Insert(event)
+		if err != nil {
+			return err
+		}
+
+		if user != nil {
+			err = app.sendUnlockEmail(r, user)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if attempt.ip.Failures >= cfg.ipThreshold {
+		err := app.models.LoginFailures.Lock(ipLoginKey(ip), attempt.ip.LastFailureAt.Add(cfg.lockoutDuration))
+		if err != nil {
+			return err
+		}
+
+		err = app.models.Audit.Insert(&data.AuditEvent{Event: data.AuditIPLocked, IP: ip})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *application) sendUnlockEmail(r *http.Request, user *data.User) error {
+	token, err := app.models.Tokens.New(user.ID, app.config.login.lockoutDuration, data.ScopeAccountUnlock)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"unlockToken":     token.Plaintext,
+			"lockoutDuration": app.config.login.lockoutDuration,
+		}
+
+		err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+
+	return nil
+}
+
+// unlockUserHandler lifts a lockout early, using the token from the lockout email.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeAccountUnlock, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unlock token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.LoginFailures.Reset(accountLoginKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeAccountUnlock, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Audit.Insert(&data.AuditEvent{
+		Event:  data.AuditAccountUnlocked,
+		UserID: user.ID,
+		IP:     clientIP(r),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account has been unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteExpiredLoginFailures(t *testing.T) {
+	app := newTestApplication(t)
+	stub := withStubDB(t, app)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		app.deleteExpiredLoginFailures(time.Millisecond, done)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !stub.ran("DELETE FROM login_failures") {
+		if time.Now().After(deadline) {
+			t.Fatal("expired login failures were never deleted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("the loop didn't stop when done was closed")
+	}
+}
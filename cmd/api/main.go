@@ -4,79 +4,332 @@ import (
 	"context"
 	"database/sql"
 	"flag"
-	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
+	"net/netip"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"backend.delmesia/internal/data"
+	"backend.delmesia/internal/jwt"
+	"backend.delmesia/internal/mailer"
 	_ "github.com/lib/pq"
 )
 
 const version = "1.0.0"
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port            int
+	adminPort       int
+	env             string
+	shutdownTimeout time.Duration
+	trustedProxies  []netip.Prefix
+	db              struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
 	}
+	dedupe struct {
+		similarity float64
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	login struct {
+		backoffBase      time.Duration
+		backoffMax       time.Duration
+		window           time.Duration
+		accountThreshold int
+		ipThreshold      int
+		lockoutDuration  time.Duration
+	}
+	totp struct {
+		issuer string
+		skew   int
+	}
+	limiter struct {
+		rps     float64
+		burst   int
+		enabled bool
+		backend string
+	}
+	compression struct {
+		enabled bool
+		minSize int
+	}
+	tracing struct {
+		exporter     string
+		otlpEndpoint string
+	}
+	cors struct {
+		trustedOrigins   []string
+		allowCredentials bool
+	}
+	auth struct {
+		mode string
+		jwt  struct {
+			keysDir    string
+			signingKID string
+			issuer     string
+			audience   string
+			ttl        time.Duration
+		}
+	}
 }
 
 type application struct {
-	config config
-	logger *log.Logger
-	models data.Models
+	config   config
+	logger   *slog.Logger
+	models   data.Models
+	mailer   mailer.Mailer
+	jwt      *jwt.Manager
+	sessions *sessionActivity
+	limiter  limiter
+	metrics  *appMetrics
+
+	// wg tracks the goroutines started with background(), and done is closed when the
+	// server shuts down to tell the long-running ones to stop.
+	wg   sync.WaitGroup
+	done chan struct{}
 }
 
 func main() {
 	var cfg config
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 
+	// The admin listener serves /metrics without authentication, so it should only be
+	// reachable from inside the deployment. With it switched off, /metrics and
+	// /debug/vars are served on the API port to users with the metrics:read permission.
+	flag.IntVar(&cfg.adminPort, "admin-port", 0, "Admin server port for /metrics and /debug/vars (0 = serve on the API port)")
+
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "Grace period for in-flight requests and background tasks on shutdown")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("GREENLIGHT_DB_DSN"), "postgreSQL DSN")
 
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 
+	// A similarity of 0 disables fuzzy duplicate matching, so pg_trgm is only needed when
+	// this is switched on.
+	flag.Float64Var(&cfg.dedupe.similarity, "dedupe-similarity", 0, "Minimum pg_trgm title similarity for duplicate detection (0 = exact normalised title only)")
+
+	// The defaults point at a local development mail server such as MailHog or
+	// Mailpit, which accepts mail without authentication.
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 1025, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.example>", "SMTP sender")
+
+	// Failed logins make the account and the client address back off exponentially,
+	// and enough of them within the window lock it out completely.
+	flag.DurationVar(&cfg.login.backoffBase, "login-backoff-base", time.Second, "Delay after the first failed login")
+	flag.DurationVar(&cfg.login.backoffMax, "login-backoff-max", time.Minute, "Maximum delay between failed logins")
+	flag.DurationVar(&cfg.login.window, "login-failure-window", 15*time.Minute, "How long failed logins are remembered")
+	flag.IntVar(&cfg.login.accountThreshold, "login-account-threshold", 10, "Failed logins before an account is locked")
+	flag.IntVar(&cfg.login.ipThreshold, "login-ip-threshold", 50, "Failed logins before a client address is locked")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 15*time.Minute, "How long a lockout lasts")
+
+	flag.StringVar(&cfg.totp.issuer, "totp-issuer", "Greenlight", "Issuer name shown in authenticator apps")
+	flag.IntVar(&cfg.totp.skew, "totp-skew", 1, "TOTP time steps accepted either side of the current one")
+
+	// Each client gets a bucket of -limiter-burst requests, refilled at -limiter-rps
+	// requests per second.
+	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+
+	// With several instances behind a load balancer, the "postgres" backend shares
+	// limits between them. "memory" limits each instance separately.
+	flag.StringVar(&cfg.limiter.backend, "limiter-backend", "memory", "Rate limiter backend (memory|postgres)")
+
+	// Responses are gzipped for clients which accept it, unless they're too small to be
+	// worth the CPU.
+	flag.BoolVar(&cfg.compression.enabled, "compression-enabled", true, "Enable gzip response compression")
+	flag.IntVar(&cfg.compression.minSize, "compression-min-size", 1024, "Smallest response body, in bytes, to compress")
+
+	// Traces go to stdout for local debugging, or to an OpenTelemetry collector over
+	// OTLP/HTTP. Either way, incoming traceparent headers are honoured.
+	flag.StringVar(&cfg.tracing.exporter, "tracing-exporter", "none", "Trace exporter (none|stdout|otlp)")
+	flag.StringVar(&cfg.tracing.otlpEndpoint, "tracing-otlp-endpoint", "localhost:4318", "OTLP/HTTP collector address")
+
+	// Behind a load balancer every request comes from the load balancer, so the client's
+	// address is taken from X-Forwarded-For for requests from these ranges. Nothing else
+	// may set it, or clients could pick their own address.
+	flag.Func("trusted-proxies", "Trusted proxy CIDR ranges (space separated)", func(val string) error {
+		prefixes, err := parseTrustedProxies(val)
+		if err != nil {
+			return err
+		}
+		cfg.trustedProxies = prefixes
+		return nil
+	})
+
+	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
+		cfg.cors.trustedOrigins = strings.Fields(val)
+		return nil
+	})
+	flag.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow CORS requests from trusted origins to include credentials")
+
+	// In "token" mode authentication tokens are opaque and stored in the database, so
+	// they can be revoked. In "jwt" mode they are signed JWTs which are verified
+	// without touching the tokens table, using keys loaded from -jwt-keys-dir.
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "token", "Authentication mode (token|jwt)")
+	flag.StringVar(&cfg.auth.jwt.keysDir, "jwt-keys-dir", "", "Directory of JWT signing and verification keys")
+	flag.StringVar(&cfg.auth.jwt.signingKID, "jwt-signing-kid", "", "ID of the key used to sign new JWTs")
+	flag.StringVar(&cfg.auth.jwt.issuer, "jwt-issuer", "greenlight", "JWT issuer (iss claim)")
+	flag.StringVar(&cfg.auth.jwt.audience, "jwt-audience", "greenlight-api", "JWT audience (aud claim)")
+	flag.DurationVar(&cfg.auth.jwt.ttl, "jwt-ttl", 24*time.Hour, "JWT lifetime")
+
 	flag.Parse()
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	// Production logs are JSON for the log aggregator; everywhere else they're meant to
+	// be read by people.
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, nil)
+	if cfg.env == "production" {
+		handler = slog.NewJSONHandler(os.Stdout, nil)
+	}
+	logger := slog.New(handler)
 
-	db, err := openDB(cfg)
+	// Browsers refuse credentialed responses with a wildcard origin, and echoing every
+	// origin instead would let any site act on a user's behalf.
+	if cfg.cors.allowCredentials && slices.Contains(cfg.cors.trustedOrigins, "*") {
+		fatal(logger, "-cors-allow-credentials can't be used with a wildcard trusted origin")
+	}
+
+	if cfg.adminPort != 0 && cfg.adminPort == cfg.port {
+		fatal(logger, "-admin-port must be different from -port")
+	}
+
+	// A smaller -compression-min-size would have compress() gzip every response, down to
+	// an empty Write().
+	if cfg.compression.enabled && cfg.compression.minSize < 1 {
+		fatal(logger, "-compression-min-size must be at least 1")
+	}
+
+	if cfg.limiter.enabled && (cfg.limiter.rps <= 0 || cfg.limiter.burst < 1) {
+		fatal(logger, "-limiter-rps and -limiter-burst must be positive")
+	}
+
+	// A zero backoff or window would let failed logins through unthrottled, and a zero
+	// threshold would lock out every account after a single failed login.
+	if cfg.login.backoffBase <= 0 || cfg.login.backoffMax < cfg.login.backoffBase {
+		fatal(logger, "-login-backoff-base must be positive and no more than -login-backoff-max")
+	}
+	if cfg.login.window <= 0 || cfg.login.lockoutDuration <= 0 {
+		fatal(logger, "-login-failure-window and -login-lockout-duration must be positive")
+	}
+	if cfg.login.accountThreshold < 1 || cfg.login.ipThreshold < 1 {
+		fatal(logger, "-login-account-threshold and -login-ip-threshold must be at least 1")
+	}
+
+	// The issuer is the first half of the "issuer:account" label in otpauth URIs, so it
+	// can't contain a colon. Each step of skew makes two more codes valid at any moment.
+	if cfg.totp.issuer == "" || strings.Contains(cfg.totp.issuer, ":") {
+		fatal(logger, "-totp-issuer must be provided and must not contain a colon")
+	}
+	if cfg.totp.skew < 0 || cfg.totp.skew > 5 {
+		fatal(logger, "-totp-skew must be between 0 and 5")
+	}
+
+	var jwtManager *jwt.Manager
+
+	switch cfg.auth.mode {
+	case "token":
+	case "jwt":
+		keys, err := jwt.LoadKeySet(cfg.auth.jwt.keysDir, cfg.auth.jwt.signingKID)
+		if err != nil {
+			fatal(logger, err.Error())
+		}
+
+		jwtManager = &jwt.Manager{
+			Keys:     keys,
+			Issuer:   cfg.auth.jwt.issuer,
+			Audience: cfg.auth.jwt.audience,
+			TTL:      cfg.auth.jwt.ttl,
+		}
+	default:
+		fatal(logger, "invalid -auth-mode", "mode", cfg.auth.mode)
+	}
+
+	tracerProvider, err := newTracerProvider(context.Background(), cfg)
 	if err != nil {
-		logger.Fatal(err)
+		fatal(logger, err.Error())
 	}
 
-	defer db.Close()
+	db, err := openDB(cfg)
+	if err != nil {
+		fatal(logger, err.Error())
+	}
 
-	logger.Printf("database connection pool established")
+	logger.Info("database connection pool established")
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db), // Use the data.NewModels() method to initialize a Models struct, passing in the connection pool as a parameter
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(db), // Use the data.NewModels() method to initialize a Models struct, passing in the connection pool as a parameter
+		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		jwt:      jwtManager,
+		sessions: newSessionActivity(),
+		metrics:  newAppMetrics(db),
+		done:     make(chan struct{}),
+	}
+
+	app.publishDebugVars(db)
+
+	switch cfg.limiter.backend {
+	case "memory":
+		app.limiter = newRateLimiter(cfg.limiter.rps, cfg.limiter.burst)
+	case "postgres":
+		app.limiter = newSharedRateLimiter(app.models.RateLimits, cfg.limiter.rps, cfg.limiter.burst, logger)
+	default:
+		fatal(logger, "invalid -limiter-backend", "backend", cfg.limiter.backend)
+	}
+
+	// Session last-used times are collected in memory and written out once a minute.
+	app.background(func() { app.flushSessionActivity(time.Minute, app.done) })
+
+	// Failed login counts are kept for unknown emails too, so they're cleared out once
+	// they've expired, whether or not the rate limiter is on.
+	app.background(func() { app.deleteExpiredLoginFailures(time.Minute, app.done) })
+
+	if cfg.limiter.enabled {
+		app.background(func() { app.limiter.janitor(app.done) })
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/healthcheck", app.healthcheckHandler)
+	err = app.serve()
 
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	// The pool is closed last, once the background tasks which might still need it have
+	// finished (or been given up on).
+	db.Close()
+
+	// Spans are exported in batches, so the last few are still buffered.
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Error("flushing traces", "error", err.Error())
+		}
+		cancel()
 	}
 
-	logger.Printf("starting %s server on %s", cfg.env, srv.Addr)
-	err = srv.ListenAndServe()
-	logger.Fatal(err)
+	if err != nil {
+		fatal(logger, err.Error())
+	}
+}
+
+// fatal logs msg at error level and exits with status 1. slog has no equivalent of
+// log.Fatal.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
 
 func openDB(cfg config) (*sql.DB, error) {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute is the route label for requests which didn't match a registered route,
+// such as 404s, 405s and CORS preflights. Labelling them by path would let any client
+// create as many time series as it liked.
+const unmatchedRoute = "unmatched"
+
+// appMetrics holds the metrics served at /metrics and the request counters served at
+// /debug/vars.
+type appMetrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+
+	// The same counts again for /debug/vars, which publishDebugVars() adds to
+	// debugVars along with the other variables served there.
+	requestsReceived  expvar.Int
+	responsesSent     expvar.Int
+	responsesByStatus expvar.Map
+	debugVars         expvar.Map
+}
+
+// newAppMetrics registers the HTTP, connection pool, Go runtime and process metrics. db
+// may be nil, in which case there are no pool metrics. Each call has its own registry,
+// rather than using the global one, so tests can create as many as they like.
+func newAppMetrics(db *sql.DB) *appMetrics {
+	m := &appMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total HTTP requests handled.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests currently being handled.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.inFlight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, "greenlight"))
+	}
+
+	return m
+}
+
+// handler serves the metrics in the Prometheus exposition format.
+func (m *appMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// metricMethod returns the method label for a request. Clients can send any token as a
+// method, so anything outside the standard set is counted as "OTHER"; otherwise a client
+// could create as many time series as it liked.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// matchedRoute is filled in by the router with the pattern of the route a request
+// matched. instrument() puts an empty one in the request context, and reads it back once
+// the request has been handled.
+type matchedRoute struct {
+	pattern string
+}
+
+// patternRouter is a httprouter.Router which records the pattern of the matched route.
+// httprouter doesn't expose it, so HandlerFunc() wraps each handler as it's registered.
+type patternRouter struct {
+	*httprouter.Router
+}
+
+func (pr patternRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	pr.Router.HandlerFunc(method, path, func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(routeContextKey).(*matchedRoute); ok {
+			route.pattern = path
+		}
+		handler(w, r)
+	})
+}
+
+// instrument records the request count, latency and in-flight metrics for every request.
+func (app *application) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		app.metrics.requestsReceived.Add(1)
+		app.metrics.inFlight.Inc()
+		defer app.metrics.inFlight.Dec()
+
+		route := &matchedRoute{}
+		r = app.contextSetRoute(r, route)
+		sr := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(sr, r)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		pattern := route.pattern
+		if pattern == "" {
+			pattern = unmatchedRoute
+		}
+		status := strconv.Itoa(sr.status)
+
+		method := metricMethod(r.Method)
+
+		app.metrics.requests.WithLabelValues(method, pattern, status).Inc()
+		app.metrics.duration.WithLabelValues(method, pattern, status).Observe(time.Since(start).Seconds())
+		app.metrics.responsesSent.Add(1)
+		app.metrics.responsesByStatus.Add(status, 1)
+	})
+}
+
+// adminRoutes returns the handler for the -admin-port listener. Anything that can reach
+// that port is trusted, so it has no authentication.
+func (app *application) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", app.metrics.handler())
+	mux.HandleFunc("GET /debug/vars", app.debugVarsHandler)
+	return mux
+}
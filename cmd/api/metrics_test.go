@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// scrape returns what Prometheus would see at /metrics.
+func scrape(t *testing.T, app *application) string {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	app.metrics.handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d", rr.Code)
+	}
+	return rr.Body.String()
+}
+
+func TestInstrumentLabelsByRoutePattern(t *testing.T) {
+	app := newTestApplication(t)
+
+	router := patternRouter{httprouter.New()}
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := app.instrument(router)
+
+	for _, path := range []string{"/v1/movies/1", "/v1/movies/2", "/v1/unknown"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	for _, method := range []string{"BREW", "PROPFIND"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/v1/movies/1", nil))
+	}
+
+	out := scrape(t, app)
+
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/v1/movies/:id",status="418"} 2`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_requests_total{method="OTHER",route="unmatched",status="405"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="/v1/movies/:id",status="418"} 2`,
+		`http_requests_in_flight 0`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics output doesn't include %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"/v1/movies/1", "BREW", "PROPFIND"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("metrics output includes %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	app := newTestApplication(t)
+
+	// On the API port, anonymous users can't read the metrics.
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("API port status = %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	// On the admin port, anyone can.
+	rr = httptest.NewRecorder()
+	app.adminRoutes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("admin port status = %d; want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if !strings.Contains(rr.Body.String(), "# TYPE http_requests_total counter") {
+		t.Errorf("unexpected body:\n%s", rr.Body.String())
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend.delmesia/internal/data"
+	"backend.delmesia/internal/validator"
+)
+
+// requestIDRX matches the request IDs we're prepared to accept from clients or proxies.
+// Anything else is replaced, so arbitrary text can't be smuggled into the logs.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestID gives every request an ID, which is sent back in the X-Request-ID header and
+// attached to its log lines and error responses. An ID set by a client or upstream proxy
+// is kept, so a request can be traced through several services.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestID(r, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newRequestID returns a random 128-bit ID, hex encoded.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// requestLogger returns the application logger with the request's ID, and its trace ID
+// if it's part of a trace, attached.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	logger := app.logger
+	if id := app.contextGetRequestID(r); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	if id := traceID(r); id != "" {
+		logger = logger.With("trace_id", id)
+	}
+	return logger
+}
+
+// statusRecorder wraps a http.ResponseWriter to remember the status code and how many
+// bytes of body were written, for logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush it.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// logRequest writes a log line for every request once it has been handled.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(sr, r)
+
+		// A handler which never writes anything gets an implicit 200 from net/http.
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		app.requestLogger(r).Info("request",
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"status", sr.status,
+			"bytes", sr.bytes,
+			"duration", time.Since(start).String(),
+			"remote_addr", r.RemoteAddr,
+			"client_ip", clientIP(r),
+		)
+	})
+}
+
+// recoverPanic turns a panic in any later handler into a 500 JSON response, rather than
+// letting net/http drop the connection without a reply. The stack trace is logged along
+// with the request that caused it.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				// http.ErrAbortHandler is how a handler asks net/http to abort the
+				// response, so it's passed through untouched.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				// The handler may have left the connection in an unknown state, so
+				// ask net/http to close it once the response has been sent.
+				w.Header().Set("Connection", "close")
+
+				app.requestLogger(r).Error(fmt.Sprintf("panic: %v", err),
+					"method", r.Method,
+					"uri", r.URL.RequestURI(),
+					"remote_addr", r.RemoteAddr,
+					"stack", string(debug.Stack()),
+				)
+
+				message := "the server encountered a problem and could not process your request."
+				app.errorResponse(w, r, http.StatusInternalServerError, message)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate identifies the user making the request from the Authorization header and
+// stores them in the request context. Both "Bearer <token>" and "ApiKey <key>" are
+// accepted. Requests without an Authorization header carry on as data.AnonymousUser.
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response will vary depending on the Authorization header, so make sure
+		// caches know about it.
+		w.Header().Add("Vary", "Authorization")
+
+		authorizationHeader := r.Header.Get("Authorization")
+
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Otherwise, we expect the value of the Authorization header to be in the
+		// format "Bearer <token>" or "ApiKey <key>".
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		token := headerParts[1]
+
+		user, sessionID, err := app.userForToken(token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if sessionID != 0 {
+			app.sessions.touch(sessionID)
+			r = app.contextSetSessionID(r, sessionID)
+		}
+
+		r = app.contextSetUser(r, user)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateAPIKey handles the "ApiKey <key>" form of the Authorization header. The
+// request runs as the key's owner, and the key itself is stored in the context so that
+// requirePermission() can restrict it to the key's scopes.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, err := app.models.APIKeys.GetForPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if key.Expired() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil || !key.AllowsIP(addr) {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.APIKeys.TouchLastUsed(key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// userForToken looks up the user a bearer token belongs to, according to the configured
+// -auth-mode, along with the ID of the session the token belongs to. JWTs aren't
+// stored, so they have a session ID of 0. Any token that isn't valid results in
+// data.ErrRecordNotFound.
+func (app *application) userForToken(token string) (*data.User, int64, error) {
+	if app.jwt != nil {
+		claims, err := app.jwt.Verify(token)
+		if err != nil {
+			return nil, 0, data.ErrRecordNotFound
+		}
+
+		id, err := strconv.ParseInt(claims.Subject, 10, 64)
+		if err != nil {
+			return nil, 0, data.ErrRecordNotFound
+		}
+
+		user, err := app.models.Users.Get(id)
+		return user, 0, err
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, 0, data.ErrRecordNotFound
+	}
+
+	return app.models.Users.GetForSession(token)
+}
+
+// requireAuthenticatedUser checks that the user is not anonymous.
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireActivatedUser checks that the user is both authenticated and activated.
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	// Wrap fn with the requireAuthenticatedUser() middleware before returning it.
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requireInteractiveUser checks that the user is authenticated, and that the request
+// wasn't made with an API key. Keys are for machine clients, and their scopes only limit
+// permission-gated routes, so they're kept away from everything that manages the account
+// itself: otherwise a key scoped to movies:read could enrol TOTP, revoke sessions or
+// mint further keys which outlive its own revocation.
+func (app *application) requireInteractiveUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requirePermission checks that the user is activated and has been granted the given
+// permission code.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAnyPermission([]string{code}, next)
+}
+
+// requireAnyPermission checks that the user is activated and has been granted at least
+// one of the given permission codes.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions, err := app.permissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for _, code := range codes {
+			if permissions.Include(code) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		app.notPermittedResponse(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
+// permissions returns the permission codes the request may use. These are the user's
+// own permissions, further limited to the key's scopes for requests made with an API
+// key.
+func (app *application) permissions(r *http.Request) (data.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := app.contextGetAPIKey(r)
+	if key == nil {
+		return permissions, nil
+	}
+
+	var scoped data.Permissions
+	for _, code := range permissions {
+		if data.Permissions(key.Scopes).Include(code) {
+			scoped = append(scoped, code)
+		}
+	}
+	return scoped, nil
+}
+
+// requireOrganization works out which organization's catalog a request is for, and
+// stores the user's membership of it in the request context. Clients which belong to
+// several organizations choose one with the X-Organization-ID header; otherwise the
+// user's only organization is used. Asking for an organization the user doesn't belong
+// to is refused outright.
+func (app *application) requireOrganization(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "X-Organization-ID")
+
+		user := app.contextGetUser(r)
+
+		var membership *data.Membership
+
+		if header := r.Header.Get("X-Organization-ID"); header != "" {
+			id, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || id < 1 {
+				app.errorResponse(w, r, http.StatusBadRequest, "invalid X-Organization-ID header")
+				return
+			}
+
+			membership, err = app.models.Organizations.GetMembership(id, user.ID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.notOrganizationMemberResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		} else {
+			memberships, err := app.models.Organizations.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			switch {
+			case len(memberships) == 0:
+				app.noOrganizationResponse(w, r)
+				return
+			case len(memberships) > 1:
+				app.organizationRequiredResponse(w, r)
+				return
+			}
+			membership = memberships[0]
+		}
+
+		r = app.contextSetMembership(r, membership)
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend.delmesia/internal/data"
+)
+
+// newTestApplication returns an application which discards its log output. It has no
+// database, so it's only suitable for code paths which don't reach the models.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	return &application{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newAppMetrics(nil),
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	app := newTestApplication(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.contextGetUser(r).IsAnonymous() {
+			t.Error("expected an anonymous user")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"missing header", "", http.StatusTeapot},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"no token", "Bearer", http.StatusUnauthorized},
+		{"short token", "Bearer abc", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+
+			app.authenticate(next).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q; want %q", rr.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
+
+func TestRequireActivatedUser(t *testing.T) {
+	app := newTestApplication(t)
+
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+
+	tests := []struct {
+		name       string
+		user       *data.User
+		wantStatus int
+	}{
+		{"anonymous", data.AnonymousUser, http.StatusUnauthorized},
+		{"inactive", &data.User{ID: 1}, http.StatusForbidden},
+		{"activated", &data.User{ID: 1, Activated: true}, http.StatusTeapot},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+			r = app.contextSetUser(r, tt.user)
+			rr := httptest.NewRecorder()
+
+			app.requireActivatedUser(next).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAccountRoutesRefuseAPIKeys(t *testing.T) {
+	app := newTestApplication(t)
+
+	// A key for user 1 which is scoped to movies:read only.
+	secret := strings.Repeat("B", 32)
+	hash := sha256.Sum256([]byte(secret))
+	withStubDB(t, app,
+		stubResult{"FROM api_keys", [][]driver.Value{{
+			int64(1), time.Now(), int64(1), "catalog sync", "AAAAAAAA", hash[:], []byte("{movies:read}"), []byte("{}"), nil, nil,
+		}}},
+		stubResult{"FROM users", [][]driver.Value{{
+			int64(1), time.Now(), "Alice", "alice@example.com", []byte("hash"), true, int64(1),
+		}}},
+	)
+
+	handler := app.routes()
+
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/v1/organizations"},
+		{http.MethodPost, "/v1/organizations"},
+		{http.MethodPost, "/v1/organizations/1/members"},
+		{http.MethodGet, "/v1/users/me/sessions"},
+		{http.MethodDelete, "/v1/users/me/sessions"},
+		{http.MethodDelete, "/v1/users/me/sessions/1"},
+		{http.MethodPost, "/v1/users/me/totp"},
+		{http.MethodPut, "/v1/users/me/totp/confirmed"},
+		{http.MethodGet, "/v1/api-keys"},
+		{http.MethodPost, "/v1/api-keys"},
+		{http.MethodDelete, "/v1/api-keys/1"},
+	}
+
+	for _, route := range routes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			r := httptest.NewRequest(route.method, route.path, strings.NewReader("{}"))
+			r.Header.Set("Authorization", "ApiKey glk_AAAAAAAA_"+secret)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "API key") {
+				t.Errorf("status = %d; want %d\n%s", rr.Code, http.StatusForbidden, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireOrganization(t *testing.T) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	membership := func(id int64, role string) []driver.Value {
+		return []driver.Value{id, created, "Organization", "organization", int64(1), role}
+	}
+
+	// GetAllForUser() and GetMembership() are told apart by their WHERE clauses.
+	const allForUser = "WHERE organization_memberships.user_id = $1"
+	const byID = "WHERE organizations.id = $1"
+
+	tests := []struct {
+		name        string
+		header      string
+		results     []stubResult
+		wantStatus  int
+		wantMessage string
+	}{
+		{"no organizations", "", nil, http.StatusForbidden, "you are not a member of any organization"},
+		{"one organization", "", []stubResult{{allForUser, [][]driver.Value{membership(1, data.RoleMember)}}}, http.StatusTeapot, ""},
+		{"several organizations", "", []stubResult{{allForUser, [][]driver.Value{membership(1, data.RoleMember), membership(2, data.RoleOwner)}}}, http.StatusBadRequest, "you must choose an organization with the X-Organization-ID header"},
+		{"chosen organization", "2", []stubResult{{byID, [][]driver.Value{membership(2, data.RoleOwner)}}}, http.StatusTeapot, ""},
+		{"not a member", "3", nil, http.StatusForbidden, "you are not a member of this organization"},
+		{"invalid header", "abc", nil, http.StatusBadRequest, "invalid X-Organization-ID header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			withStubDB(t, app, tt.results...)
+
+			next := func(w http.ResponseWriter, r *http.Request) {
+				app.contextGetMembership(r)
+				w.WriteHeader(http.StatusTeapot)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Organization-ID", tt.header)
+			}
+			r = app.contextSetUser(r, &data.User{ID: 1, Activated: true})
+			rr := httptest.NewRecorder()
+
+			app.requireOrganization(next).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d; want %d\n%s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantMessage == "" {
+				return
+			}
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Error != tt.wantMessage {
+				t.Errorf("error = %q; want %q", body.Error, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	app := newTestApplication(t)
+
+	// readJSON() panics when handed something it can't decode into, which is exactly
+	// the kind of programming error this middleware is there to catch.
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var dst struct{}
+		app.readJSON(w, r, dst)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(`{}`))
+	rr := httptest.NewRecorder()
+
+	app.recoverPanic(next).ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if got := rr.Header().Get("Connection"); got != "close" {
+		t.Errorf("Connection = %q; want %q", got, "close")
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Error == "" {
+		t.Errorf("expected a JSON error body; got %q (%v)", rr.Body.String(), err)
+	}
+}
+
+func TestRequestIDAndLogging(t *testing.T) {
+	var logs bytes.Buffer
+	app := newTestApplication(t)
+	app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.notFoundResponse(w, r)
+	})
+	handler := app.requestID(app.logRequest(next))
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"generated", "", false},
+		{"propagated", "abc-123.def_456", true},
+		{"unsafe", "abc\nINFO forged log line", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/0", nil)
+			if tt.incoming != "" {
+				r.Header.Set("X-Request-ID", tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, r)
+
+			id := rr.Header().Get("X-Request-ID")
+			if !requestIDRX.MatchString(id) {
+				t.Fatalf("X-Request-ID = %q is not a valid request ID", id)
+			}
+			if tt.keep && id != tt.incoming {
+				t.Errorf("X-Request-ID = %q; want %q", id, tt.incoming)
+			}
+			if !tt.keep && id == tt.incoming {
+				t.Errorf("expected X-Request-ID %q to be replaced", tt.incoming)
+			}
+
+			var body struct {
+				RequestID string `json:"request_id"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.RequestID != id {
+				t.Errorf("error response request_id = %q; want %q", body.RequestID, id)
+			}
+
+			var line struct {
+				Msg       string `json:"msg"`
+				RequestID string `json:"request_id"`
+				Status    int    `json:"status"`
+				URI       string `json:"uri"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+				t.Fatalf("couldn't decode log line %q: %v", logs.String(), err)
+			}
+			if line.Msg != "request" || line.RequestID != id || line.Status != http.StatusNotFound || line.URI != "/v1/movies/0" {
+				t.Errorf("unexpected log line %s", logs.String())
+			}
+		})
+	}
+}
+
+func TestErrorResponsesCarryRequestID(t *testing.T) {
+	app := newTestApplication(t)
+
+	responses := map[string]func(w http.ResponseWriter, r *http.Request){
+		"not found":           app.notFoundResponse,
+		"two factor required": app.twoFactorRequiredResponse,
+		"duplicate movie": func(w http.ResponseWriter, r *http.Request) {
+			app.duplicateMovieResponse(w, r, []*data.Movie{{ID: 1, Title: "Casablanca", Year: 1942}})
+		},
+	}
+
+	for name, send := range responses {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+			r = app.contextSetRequestID(r, "abc-123")
+			rr := httptest.NewRecorder()
+
+			send(rr, r)
+
+			var body map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body["request_id"] != "abc-123" || body["error"] == nil {
+				t.Errorf("body = %s; want an error with request_id \"abc-123\"", rr.Body.String())
+			}
+		})
+	}
+}
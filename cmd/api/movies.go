@@ -1,21 +1,49 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
 
 	"backend.delmesia/internal/data"
 	"backend.delmesia/internal/validator"
+	"github.com/julienschmidt/httprouter"
 )
 
+// movieEditors are the permissions which allow changing movies. Holders of movies:write
+// can change anything in the catalog; contributors can only change movies they created.
+var movieEditors = []string{"movies:write", "movies:contribute"}
+
+// movies returns the movie model scoped to the organization chosen for the request by
+// requireOrganization(), so handlers can't reach another tenant's catalog by mistake. Its
+// queries are traced as part of the request.
+func (app *application) movies(r *http.Request) data.MovieModel {
+	return app.models.Movies.ForOrganization(app.contextGetMembership(r).Organization.ID).WithContext(r.Context())
+}
+
+// canEditMovie reports whether the request may change or delete movie.
+func (app *application) canEditMovie(r *http.Request, movie *data.Movie) (bool, error) {
+	permissions, err := app.permissions(r)
+	if err != nil {
+		return false, err
+	}
+
+	if permissions.Include("movies:write") {
+		return true, nil
+	}
+
+	user := app.contextGetUser(r)
+	return permissions.Include("movies:contribute") && movie.CreatedBy == user.ID, nil
+}
+
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title       string           `json:"title"`
+		Year        int32            `json:"year"`
+		Runtime     data.Runtime     `json:"runtime"`
+		Genres      []string         `json:"genres"`
+		ExternalIDs data.ExternalIDs `json:"external_ids"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -26,14 +54,20 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Copy the values from the input struct above to a new movie struct
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		CreatedBy:   app.contextGetUser(r).ID,
+		Title:       input.Title,
+		Year:        input.Year,
+		Runtime:     input.Runtime,
+		Genres:      input.Genres,
+		ExternalIDs: input.ExternalIDs,
 	}
 	// Initialize a new validator instance
 	v := validator.New()
 
+	// ?force=true skips duplicate detection for genuinely distinct films which happen to
+	// share a title and year.
+	force := app.readBool(r.URL.Query(), "force", false, v)
+
 	// Call the ValidateMovie() function and return a response containing the errors if
 	// any of the checks fails
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -41,12 +75,29 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Calling the Insert() method on the movies model, passing in a pointer to the
-	// validated movie struct. This will create a record in the database and update the
-	// movie struct with the system-generated value.
-	err = app.models.Movies.Insert(movie)
+	// Unless the duplicate check is skipped, it runs in the same transaction as the
+	// insert, so that two clients creating the same film at once can't both pass it.
+	var candidates []*data.Movie
+	if force {
+		err = app.movies(r).Insert(movie)
+	} else {
+		candidates, err = app.movies(r).InsertUnlessDuplicate(movie, app.config.dedupe.similarity)
+	}
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		// An external ID which already belongs to another movie is reported as a
+		// validation error against that field.
+		var duplicateErr data.DuplicateExternalIDError
+		switch {
+		case errors.As(err, &duplicateErr):
+			v.AddError("external_ids."+duplicateErr.Provider, "is already attached to another movie")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if len(candidates) > 0 {
+		app.duplicateMovieResponse(w, r, candidates)
 		return
 	}
 
@@ -66,6 +117,12 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
+	// httprouter doesn't allow the static /v1/movies/lookup route to sit alongside the
+	// /v1/movies/:id wildcard, so lookups are dispatched from here instead.
+	if httprouter.ParamsFromContext(r.Context()).ByName("id") == "lookup" {
+		app.lookupMovieHandler(w, r)
+		return
+	}
 
 	id, err := app.readIDParam(r)
 	if err != nil || id < 1 {
@@ -73,13 +130,15 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie := data.Movie{
-		ID:        id,
-		CreatedAt: time.Now(),
-		Title:     "Casablanca",
-		Runtime:   102,
-		Genres:    []string{"drama", "romance", "war"},
-		Version:   1,
+	movie, err := app.movies(r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.redirectMovieAlias(w, r, id)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
 	// Encode the struct to JSON and send it as the HTTP response.
@@ -89,3 +148,355 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// lookupMovieHandler resolves an identifier from an upstream catalog to our own movie
+// record, e.g. GET /v1/movies/lookup?imdb=tt0034583. Exactly one provider must be given.
+func (app *application) lookupMovieHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	var provider, value string
+	for _, p := range data.Providers {
+		if qs.Has(p) {
+			v.Check(provider == "", "provider", "must specify exactly one of imdb, tmdb or eidr")
+			provider, value = p, qs.Get(p)
+		}
+	}
+	v.Check(provider != "", "provider", "must specify exactly one of imdb, tmdb or eidr")
+
+	if v.Valid() {
+		data.ValidateExternalID(v, provider, value)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.movies(r).GetByExternalID(provider, value)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// redirectMovieAlias sends a 301 to the movie that id was merged into, or a 404 if id
+// isn't an alias either.
+func (app *application) redirectMovieAlias(w http.ResponseWriter, r *http.Request, id int64) {
+	movieID, err := app.movies(r).GetAlias(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/v1/movies/%d", movieID), http.StatusMovedPermanently)
+}
+
+// mergeMovieHandler folds the movie given by source_id into the movie in the URL. The
+// source movie is deleted and its ID becomes an alias which redirects to the target.
+func (app *application) mergeMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		SourceID int64 `json:"source_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.SourceID > 0, "source_id", "must be provided")
+	v.Check(input.SourceID != id, "source_id", "must not be the same as the target movie")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	target, err := app.movies(r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	source, err := app.movies(r).Get(input.SourceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("source_id", "must refer to an existing movie")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if data.MergeMovies(v, target, source); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.movies(r).Merge(target, source.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict), errors.Is(err, data.ErrRecordNotFound):
+			// Either movie changed or disappeared since we read it.
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": target}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateMovieHandler applies a partial update to a movie. Only the fields present in the
+// request body are changed.
+func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.movies(r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.canEditMovie(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notMovieOwnerResponse(w, r)
+		return
+	}
+
+	// Pointers let us tell a field that wasn't sent apart from one set to its zero value.
+	// The same goes for each external ID, so that sending one of them leaves the others
+	// alone; an empty string removes an ID.
+	var input struct {
+		Title       *string       `json:"title"`
+		Year        *int32        `json:"year"`
+		Runtime     *data.Runtime `json:"runtime"`
+		Genres      []string      `json:"genres"`
+		ExternalIDs struct {
+			IMDb *string `json:"imdb"`
+			TMDB *string `json:"tmdb"`
+			EIDR *string `json:"eidr"`
+		} `json:"external_ids"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Title != nil {
+		movie.Title = *input.Title
+	}
+	if input.Year != nil {
+		movie.Year = *input.Year
+	}
+	if input.Runtime != nil {
+		movie.Runtime = *input.Runtime
+	}
+	if input.Genres != nil {
+		movie.Genres = input.Genres
+	}
+	if input.ExternalIDs.IMDb != nil {
+		movie.ExternalIDs.IMDb = *input.ExternalIDs.IMDb
+	}
+	if input.ExternalIDs.TMDB != nil {
+		movie.ExternalIDs.TMDB = *input.ExternalIDs.TMDB
+	}
+	if input.ExternalIDs.EIDR != nil {
+		movie.ExternalIDs.EIDR = *input.ExternalIDs.EIDR
+	}
+
+	v := validator.New()
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.movies(r).Update(movie)
+	if err != nil {
+		var duplicateErr data.DuplicateExternalIDError
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.As(err, &duplicateErr):
+			v.AddError("external_ids."+duplicateErr.Provider, "is already attached to another movie")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.movies(r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.canEditMovie(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notMovieOwnerResponse(w, r)
+		return
+	}
+
+	err = app.movies(r).Delete(movie.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// transferMovieHandler hands a movie over to another member of the organization, e.g.
+// when its contributor leaves. Only the organization's owners and admins may do this.
+func (app *application) transferMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	membership := app.contextGetMembership(r)
+	if !membership.CanManageCatalog() {
+		app.notOrganizationAdminResponse(w, r)
+		return
+	}
+
+	var input struct {
+		UserID int64 `json:"user_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.UserID > 0, "user_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The new owner must belong to the organization, or they'd own a movie they can't
+	// even see.
+	_, err = app.models.Organizations.GetMembership(membership.Organization.ID, input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "must be a member of the organization")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.movies(r).SetOwner(id, input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, err := app.movies(r).Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
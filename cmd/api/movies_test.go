@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend.delmesia/internal/data"
+	"github.com/julienschmidt/httprouter"
+)
+
+// patchMovie sends body to updateMovieHandler for movie 1 as user 1, a member of
+// organization 7 with the given permissions. Movie 1 was created by createdBy and has an
+// IMDb and a TMDB ID.
+func patchMovie(t *testing.T, createdBy int64, permissions []string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var permissionRows [][]driver.Value
+	for _, code := range permissions {
+		permissionRows = append(permissionRows, []driver.Value{code})
+	}
+
+	app := newTestApplication(t)
+	withStubDB(t, app,
+		stubResult{"FROM movies", [][]driver.Value{{
+			int64(1), time.Now(), int64(7), createdBy, "Casablanca", int64(1942), int64(102), []byte("{drama}"),
+			"tt0034583", "289", "", int64(1),
+		}}},
+		stubResult{"FROM permissions", permissionRows},
+		stubResult{"UPDATE movies", [][]driver.Value{{int64(2)}}},
+	)
+
+	r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params{{Key: "id", Value: "1"}}))
+	r = app.contextSetUser(r, &data.User{ID: 1, Activated: true})
+	r = app.contextSetMembership(r, &data.Membership{Organization: &data.Organization{ID: 7}, UserID: 1, Role: data.RoleMember})
+	rr := httptest.NewRecorder()
+
+	app.updateMovieHandler(rr, r)
+	return rr
+}
+
+func TestUpdateMovieChecksOwnership(t *testing.T) {
+	tests := []struct {
+		name        string
+		createdBy   int64
+		permissions []string
+		wantStatus  int
+	}{
+		{"contributor, own movie", 1, []string{"movies:contribute"}, http.StatusOK},
+		{"contributor, someone else's movie", 2, []string{"movies:contribute"}, http.StatusForbidden},
+		{"contributor, movie from before created_by", 0, []string{"movies:contribute"}, http.StatusForbidden},
+		{"writer, someone else's movie", 2, []string{"movies:write"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := patchMovie(t, tt.createdBy, tt.permissions, `{"title": "Casablanca"}`)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d\n%s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestUpdateMovieMergesExternalIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want data.ExternalIDs
+	}{
+		{"not sent", `{"title": "Casablanca"}`, data.ExternalIDs{IMDb: "tt0034583", TMDB: "289"}},
+		{"one changed", `{"external_ids": {"eidr": "10.5240/7791-8534-2C23-9030-8610-5"}}`, data.ExternalIDs{IMDb: "tt0034583", TMDB: "289", EIDR: "10.5240/7791-8534-2C23-9030-8610-5"}},
+		{"one removed", `{"external_ids": {"tmdb": ""}}`, data.ExternalIDs{IMDb: "tt0034583"}},
+		{"null is ignored", `{"external_ids": {"imdb": null}}`, data.ExternalIDs{IMDb: "tt0034583", TMDB: "289"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := patchMovie(t, 1, []string{"movies:write"}, tt.body)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d; want %d\n%s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+
+			var response struct {
+				Movie data.Movie `json:"movie"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Movie.ExternalIDs != tt.want {
+				t.Errorf("external_ids = %+v; want %+v", response.Movie.ExternalIDs, tt.want)
+			}
+		})
+	}
+}
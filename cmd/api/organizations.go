@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"backend.delmesia/internal/data"
+	"backend.delmesia/internal/validator"
+)
+
+// createOrganizationHandler creates a new organization, with an empty catalog, owned by
+// the user making the request.
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	org := &data.Organization{
+		Name: input.Name,
+		Slug: input.Slug,
+	}
+
+	v := validator.New()
+
+	if data.ValidateOrganization(v, org); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Organizations.Insert(org, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSlug):
+			v.AddError("slug", "an organization with this slug already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organizations/%d", org.ID))
+
+	membership := &data.Membership{Organization: org, UserID: user.ID, Role: data.RoleOwner}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"membership": membership}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listOrganizationsHandler lists the organizations the user belongs to, and their role
+// in each.
+func (app *application) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	memberships, err := app.models.Organizations.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"memberships": memberships}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addOrganizationMemberHandler adds an existing user, identified by email address, to an
+// organization. Only the organization's owners and admins may do this, and only owners
+// may create further owners.
+func (app *application) addOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Organizations the user doesn't belong to are reported as not found, so their IDs
+	// can't be probed.
+	membership, err := app.models.Organizations.GetMembership(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !membership.CanManageMembers() || (input.Role == data.RoleOwner && membership.Role != data.RoleOwner) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateRole(v, input.Role)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	member, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching user account found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Organizations.AddMember(id, member.ID, input.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateMembership):
+			v.AddError("email", "this user is already a member of the organization")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	added := &data.Membership{Organization: membership.Organization, UserID: member.ID, Role: input.Role}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"membership": added}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend.delmesia/internal/data"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitDecision is the outcome of checking a request against a client's limit.
+type rateLimitDecision struct {
+	allowed bool
+	// limit is the size of the client's burst, and remaining how many more requests it
+	// could make right now.
+	limit     int
+	remaining int
+	// reset is how long until the client's allowance is completely refilled, and
+	// retryAfter how long until it can make another request.
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// limiter decides whether a client identified by key may make a request. janitor does
+// any periodic housekeeping until done is closed, and is run in its own goroutine.
+type limiter interface {
+	allow(key string, now time.Time) rateLimitDecision
+	janitor(done <-chan struct{})
+}
+
+// rateLimiter keeps a token bucket per client. Each bucket holds up to burst tokens and
+// is refilled at rps tokens per second; every request takes one token.
+type rateLimiter struct {
+	rps   rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*rateLimitClient
+}
+
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rps:     rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*rateLimitClient),
+	}
+}
+
+// allow takes a token from key's bucket, if there's one to take.
+func (l *rateLimiter) allow(key string, now time.Time) rateLimitDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[key]
+	if !ok {
+		client = &rateLimitClient{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = now
+
+	allowed := client.limiter.AllowN(now, 1)
+	tokens := client.limiter.TokensAt(now)
+
+	decision := rateLimitDecision{
+		allowed:   allowed,
+		limit:     l.burst,
+		remaining: max(int(math.Floor(tokens)), 0),
+		reset:     l.refillTime(float64(l.burst) - tokens),
+	}
+	if !allowed {
+		decision.retryAfter = l.refillTime(1 - tokens)
+	}
+
+	return decision
+}
+
+// refillTime returns how long it takes to refill the given number of tokens.
+func (l *rateLimiter) refillTime(tokens float64) time.Duration {
+	if tokens <= 0 || l.rps <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / float64(l.rps) * float64(time.Second))
+}
+
+// evict forgets clients which haven't made a request since before cutoff. A forgotten
+// client starts again with a full bucket, so cutoff should be long enough ago for any
+// bucket to have refilled.
+func (l *rateLimiter) evict(cutoff time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, client := range l.clients {
+		if client.lastSeen.Before(cutoff) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// janitor evicts clients which have been idle for more than three minutes, once a
+// minute, so the map doesn't grow without bound. It's meant to be run in its own
+// goroutine, and returns when done is closed.
+func (l *rateLimiter) janitor(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			l.evict(now.Add(-3 * time.Minute))
+		case <-done:
+			return
+		}
+	}
+}
+
+// sharedRateLimiter keeps its counters in PostgreSQL, so that every instance of the API
+// behind a load balancer enforces the same limit. It uses a sliding window of
+// burst/rps seconds, which allows the same sustained rate as the in-memory token
+// buckets.
+//
+// If the database can't be reached, the local token buckets are used instead for a
+// while, so that requests are still limited (per instance) rather than failing.
+type sharedRateLimiter struct {
+	model  data.RateLimitModel
+	limit  int
+	window time.Duration
+	local  *rateLimiter
+	logger *slog.Logger
+
+	mu               sync.Mutex
+	unavailableUntil time.Time
+}
+
+// sharedRateLimiterRetry is how long to stick with the local fallback after a database
+// error before trying the database again.
+const sharedRateLimiterRetry = 10 * time.Second
+
+func newSharedRateLimiter(model data.RateLimitModel, rps float64, burst int, logger *slog.Logger) *sharedRateLimiter {
+	return &sharedRateLimiter{
+		model:  model,
+		limit:  burst,
+		window: time.Duration(float64(burst) / rps * float64(time.Second)),
+		local:  newRateLimiter(rps, burst),
+		logger: logger,
+	}
+}
+
+func (l *sharedRateLimiter) allow(key string, now time.Time) rateLimitDecision {
+	if !l.available(now) {
+		return l.local.allow(key, now)
+	}
+
+	w, err := l.model.Hit(key, l.window)
+	if err != nil {
+		l.mu.Lock()
+		l.unavailableUntil = now.Add(sharedRateLimiterRetry)
+		l.mu.Unlock()
+
+		l.logger.Warn("rate limit database unavailable, using local limits", "retry_in", sharedRateLimiterRetry.String(), "error", err.Error())
+		return l.local.allow(key, now)
+	}
+
+	// The hit has already been counted, so it's included in the estimate. The window
+	// was placed by the database's clock, so that's the one to measure it with.
+	estimate := w.Estimate(w.Now)
+
+	decision := rateLimitDecision{
+		allowed:   estimate <= float64(l.limit),
+		limit:     l.limit,
+		remaining: max(int(math.Floor(float64(l.limit)-estimate)), 0),
+		reset:     w.Reset(w.Now),
+	}
+	if !decision.allowed {
+		decision.retryAfter = w.RetryAfter(w.Now, l.limit)
+	}
+
+	return decision
+}
+
+func (l *sharedRateLimiter) available(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return !now.Before(l.unavailableUntil)
+}
+
+// janitor deletes counters for windows which no longer affect any estimate, and evicts
+// idle clients from the local fallback, once a minute until done is closed.
+func (l *sharedRateLimiter) janitor(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			l.local.evict(now.Add(-3 * time.Minute))
+
+			err := l.model.DeleteExpired(2 * l.window)
+			if err != nil {
+				l.logger.Error(err.Error())
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// rateLimitIP limits every request per IP address, before it's authenticated, so that
+// guessing tokens and API keys is throttled like any other traffic from the address.
+// It must run before authenticate(), and rateLimit() after it.
+//
+// CORS preflights aren't counted. Browsers send them by themselves, doubling the cost
+// of cross-origin requests, and a refused preflight is reported to the calling script
+// as a network error rather than a 429 it could act on.
+func (app *application) rateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.limiter.enabled || isPreflight(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		decision := app.limiter.allow("ip:"+clientIP(r), time.Now())
+		setRateLimitHeaders(w, decision)
+
+		if !decision.allowed {
+			app.rateLimitExceededResponse(w, r, decision.retryAfter)
+			return
+		}
+
+		r = app.contextSetRateLimit(r, decision)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit also limits authenticated requests per user, so that a user can't get
+// around their limit by spreading requests over several addresses. The RateLimit
+// headers describe whichever of the two limits is closer to running out.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		// Anonymous requests have already been limited by rateLimitIP(). Preflights
+		// never carry credentials, so they're always anonymous.
+		if !app.config.limiter.enabled || user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		decision := app.limiter.allow(fmt.Sprintf("user:%d", user.ID), time.Now())
+		if ip, ok := app.contextGetRateLimit(r); !ok || decision.remaining <= ip.remaining {
+			setRateLimitHeaders(w, decision)
+		}
+
+		if !decision.allowed {
+			app.rateLimitExceededResponse(w, r, decision.retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, decision rateLimitDecision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(decision.reset.Seconds()))))
+}
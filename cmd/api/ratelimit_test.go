@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"backend.delmesia/internal/data"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(2, 4)
+	now := time.Unix(1_700_000_000, 0)
+
+	// The first four requests use up the burst.
+	for i := 0; i < 4; i++ {
+		d := l.allow("ip:192.0.2.1", now)
+		if !d.allowed {
+			t.Fatalf("request %d was refused", i+1)
+		}
+		if d.remaining != 3-i {
+			t.Errorf("request %d: remaining = %d; want %d", i+1, d.remaining, 3-i)
+		}
+	}
+
+	d := l.allow("ip:192.0.2.1", now)
+	if d.allowed {
+		t.Fatal("expected the fifth request to be refused")
+	}
+	if d.retryAfter != 500*time.Millisecond {
+		t.Errorf("retryAfter = %v; want 500ms", d.retryAfter)
+	}
+	if d.reset != 2*time.Second {
+		t.Errorf("reset = %v; want 2s", d.reset)
+	}
+
+	// Other clients have their own buckets.
+	if !l.allow("ip:192.0.2.2", now).allowed {
+		t.Error("a different client was refused")
+	}
+
+	// Half a second later one token has been refilled.
+	if !l.allow("ip:192.0.2.1", now.Add(500*time.Millisecond)).allowed {
+		t.Error("expected a request to be allowed once a token was refilled")
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	l := newRateLimiter(2, 4)
+	now := time.Unix(1_700_000_000, 0)
+
+	l.allow("ip:192.0.2.1", now)
+	l.allow("ip:192.0.2.2", now.Add(time.Minute))
+
+	l.evict(now.Add(30 * time.Second))
+
+	if _, ok := l.clients["ip:192.0.2.1"]; ok {
+		t.Error("expected the idle client to be evicted")
+	}
+	if _, ok := l.clients["ip:192.0.2.2"]; !ok {
+		t.Error("expected the recent client to be kept")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.limiter = newRateLimiter(1, 1)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+		rr := httptest.NewRecorder()
+		app.rateLimitIP(app.authenticate(app.rateLimit(next))).ServeHTTP(rr, r)
+		return rr
+	}
+
+	if rr := send(); rr.Code != http.StatusTeapot {
+		t.Fatalf("first request: status = %d; want %d", rr.Code, http.StatusTeapot)
+	}
+
+	rr := send()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status = %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	for header, want := range map[string]string{
+		"RateLimit-Limit":     "1",
+		"RateLimit-Remaining": "0",
+		"Retry-After":         "1",
+	} {
+		if got := rr.Header().Get(header); got != want {
+			t.Errorf("%s = %q; want %q", header, got, want)
+		}
+	}
+}
+
+func TestRateLimitSkipsPreflights(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.cors.trustedOrigins = []string{"https://app.example.com"}
+	app.limiter = newRateLimiter(1, 1)
+
+	router := patternRouter{httprouter.New()}
+	router.GlobalOPTIONS = http.HandlerFunc(app.preflightHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/movies", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := app.enableCORS(app.rateLimitIP(app.authenticate(app.rateLimit(router))))
+
+	// However many preflights there are, the request itself still has its allowance.
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodOptions, "/v1/movies", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("preflight %d: status = %d; want %d", i+1, rr.Code, http.StatusNoContent)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("request: status = %d; want %d", rr.Code, http.StatusTeapot)
+	}
+
+	// A plain OPTIONS request isn't a preflight, so it's counted as usual.
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, "/v1/movies", nil))
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("OPTIONS: status = %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitInvalidCredentials(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.limiter = newRateLimiter(1, 3)
+	// No tokens or API keys exist, so every lookup fails.
+	withStubDB(t, app)
+
+	handler := app.rateLimitIP(app.authenticate(app.rateLimit(http.NotFoundHandler())))
+
+	statuses := make([]int, 5)
+	for i := range statuses {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+		if i%2 == 0 {
+			r.Header.Set("Authorization", "Bearer "+strings.Repeat("A", 25)+strconv.Itoa(i))
+		} else {
+			r.Header.Set("Authorization", "ApiKey glk_"+strings.Repeat("A", 8)+"_"+strings.Repeat("B", 32))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		statuses[i] = rr.Code
+	}
+
+	want := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %v; want %v", statuses, want)
+	}
+}
+
+func TestRateLimitAuthenticatedUsers(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.limiter = newRateLimiter(1, 2)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	// Each user has their own allowance, even from the same address, but the address's
+	// allowance applies as well.
+	send := func(user *data.User, addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+		r.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		app.rateLimitIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			app.rateLimit(next).ServeHTTP(w, app.contextSetUser(r, user))
+		})).ServeHTTP(rr, r)
+		return rr
+	}
+
+	alice := &data.User{ID: 1, Activated: true}
+
+	if rr := send(alice, "192.0.2.1:1234"); rr.Code != http.StatusTeapot || rr.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("first request: status = %d, RateLimit-Remaining = %q", rr.Code, rr.Header().Get("RateLimit-Remaining"))
+	}
+	// A different address, but the same user.
+	if rr := send(alice, "192.0.2.2:1234"); rr.Code != http.StatusTeapot || rr.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("second request: status = %d, RateLimit-Remaining = %q", rr.Code, rr.Header().Get("RateLimit-Remaining"))
+	}
+	if rr := send(alice, "192.0.2.3:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("third request: status = %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestSharedRateLimiterFallback(t *testing.T) {
+	// Nothing listens on port 1, so every query fails straight away.
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l := newSharedRateLimiter(data.RateLimitModel{DB: db}, 1, 2, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Unix(1_700_000_000, 0)
+
+	// The local buckets take over, so the limit still applies.
+	for i := 0; i < 2; i++ {
+		if !l.allow("ip:192.0.2.1", now).allowed {
+			t.Fatalf("request %d was refused", i+1)
+		}
+	}
+	if l.allow("ip:192.0.2.1", now).allowed {
+		t.Error("expected the third request to be refused by the local fallback")
+	}
+
+	if l.available(now) {
+		t.Error("expected the database to be marked unavailable")
+	}
+	if !l.available(now.Add(sharedRateLimiterRetry)) {
+		t.Error("expected the database to be retried after the back-off")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses the -trusted-proxies flag: a space separated list of CIDR
+// ranges, or single addresses, of the load balancers and proxies in front of the API.
+func parseTrustedProxies(val string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Fields(val) {
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", field)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// trustedProxy reports whether addr is in one of the -trusted-proxies ranges.
+func (app *application) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range app.config.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP works out the address of the client and stores it in the request context for
+// clientIP(). Behind a load balancer the peer is the load balancer, so when the peer is
+// a trusted proxy the client is taken from X-Forwarded-For instead: the nearest address
+// in it which isn't also a trusted proxy. Addresses further along were supplied by the
+// client and can't be believed.
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+
+		if addr, err := netip.ParseAddr(ip); err == nil && app.trustedProxy(addr) {
+			ip = forwardedFor(r.Header.Values("X-Forwarded-For"), addr, app.trustedProxy)
+		}
+
+		ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// forwardedFor walks back along X-Forwarded-For from peer, the trusted proxy which
+// sent the request, and returns the first address which isn't trusted. If a proxy
+// passed on something that isn't an address, the proxy itself is the best that can be
+// said of the client.
+func forwardedFor(headers []string, peer netip.Addr, trusted func(netip.Addr) bool) string {
+	var hops []string
+	for _, header := range headers {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr
+		if !trusted(addr) {
+			break
+		}
+	}
+
+	return client.Unmap().String()
+}
+
+// clientIP returns the IP address of the client, without the port. That's the one
+// found by realIP(), or the peer's address for requests which haven't been through it.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the address of the peer the request came from, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
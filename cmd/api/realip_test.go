@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	app := newTestApplication(t)
+
+	var err error
+	app.config.trustedProxies, err = parseTrustedProxies("10.0.0.0/8 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		wantClientIP string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"trusted peer", "10.0.0.5:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed entries", "10.0.0.5:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of proxies", "10.0.0.5:1234", []string{"198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"several headers", "10.0.0.5:1234", []string{"203.0.113.9", "198.51.100.7"}, "198.51.100.7"},
+		{"all trusted", "10.0.0.5:1234", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"no header", "10.0.0.5:1234", nil, "10.0.0.5"},
+		{"garbage", "10.0.0.5:1234", []string{"198.51.100.7, nonsense"}, "10.0.0.5"},
+		{"IPv6 proxy", "[2001:db8::1]:1234", []string{"2001:db8::99"}, "2001:db8::99"},
+		{"IPv4-mapped proxy", "[::ffff:10.0.0.5]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			var got string
+			app.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.wantClientIP {
+				t.Errorf("clientIP() = %q; want %q", got, tt.wantClientIP)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies("10.0.0.0/8  192.0.2.1 ::ffff:192.0.2.2 2001:db8::/32 10.1.2.3/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "192.0.2.2/32", "2001:db8::/32", "10.0.0.0/8"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("prefixes = %v; want %v", prefixes, want)
+	}
+	for i := range want {
+		if prefixes[i].String() != want[i] {
+			t.Errorf("prefix %d = %s; want %s", i, prefixes[i], want[i])
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0"} {
+		if _, err := parseTrustedProxies(invalid); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded; want an error", invalid)
+		}
+	}
+}
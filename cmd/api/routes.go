@@ -6,16 +6,72 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-func (app *application) routes() *httprouter.Router {
-	// Initialize a new http router instance.
-	router := httprouter.New()
+func (app *application) routes() http.Handler {
+	// Initialize a new http router instance. patternRouter records which route each
+	// request matched, so that metrics can be labelled by route.
+	router := patternRouter{httprouter.New()}
 
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	router.GlobalOPTIONS = http.HandlerFunc(app.preflightHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requireAnyPermission(movieEditors, app.requireOrganization(app.createMovieHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.requireOrganization(app.showMovieHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requireAnyPermission(movieEditors, app.requireOrganization(app.updateMovieHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requireAnyPermission(movieEditors, app.requireOrganization(app.deleteMovieHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/owner", app.requireAnyPermission(movieEditors, app.requireOrganization(app.transferMovieHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/merge", app.requirePermission("movies:write", app.requireOrganization(app.mergeMovieHandler)))
 
-	return router
+	router.HandlerFunc(http.MethodGet, "/v1/organizations", app.requireInteractiveUser(app.requireActivatedUser(app.listOrganizationsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/organizations", app.requireInteractiveUser(app.requireActivatedUser(app.createOrganizationHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/organizations/:id/members", app.requireInteractiveUser(app.requireActivatedUser(app.addOrganizationMemberHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/unlocked", app.unlockUserHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireInteractiveUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions", app.requireInteractiveUser(app.deleteOtherSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireInteractiveUser(app.deleteSessionHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireInteractiveUser(app.requireActivatedUser(app.enrollTOTPHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp/confirmed", app.requireInteractiveUser(app.requireActivatedUser(app.confirmTOTPHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/sessions", app.requirePermission("users:admin", app.adminListSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/sessions/:session_id", app.requirePermission("users:admin", app.adminDeleteSessionHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireInteractiveUser(app.requireActivatedUser(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireInteractiveUser(app.requireActivatedUser(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireInteractiveUser(app.requireActivatedUser(app.deleteAPIKeyHandler)))
+
+	// Without a separate admin listener, /metrics and /debug/vars are served here, but
+	// only to users allowed to see them.
+	if app.config.adminPort == 0 {
+		router.HandlerFunc(http.MethodGet, "/metrics", app.requirePermission("metrics:read", app.metrics.handler().ServeHTTP))
+		router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("metrics:read", app.debugVarsHandler))
+	}
+
+	if app.jwt != nil {
+		router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
+	}
+
+	// Wrap the router with the authenticate() middleware, so that every request
+	// carries a user (possibly anonymous) in its context. rateLimit() needs to know who
+	// the user is, so it comes after that, while rateLimitIP() comes before it so that
+	// requests with bad credentials are limited too. enableCORS() comes before all
+	// three, so that browsers can read 401 and 429 responses too. recoverPanic() catches
+	// panics in all of those, and sits inside logRequest() so that the 500 it sends is
+	// logged.
+	// compress() sits inside logRequest(), so that the logs show the bytes actually
+	// sent, and outside recoverPanic(), so that error responses are compressed too.
+	// traceRequest() starts the request's span before anything logs, so that log lines
+	// can carry the trace ID. instrument() comes next, so that the metrics count every
+	// response, and requestID() goes next so that every log line can carry the ID.
+	// realIP() goes outermost, so that everything sees the client's real address.
+	return app.realIP(app.requestID(app.instrument(app.traceRequest(app.logRequest(app.compress(app.recoverPanic(app.enableCORS(app.rateLimitIP(app.authenticate(app.rateLimit(router)))))))))))
 }
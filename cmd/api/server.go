@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the HTTP server until it receives SIGINT or SIGTERM, then shuts down
+// gracefully: it stops accepting connections, lets in-flight requests finish, tells the
+// long-running background loops to stop and waits for every background task. All of
+// this has to happen within the -shutdown-timeout grace period. A nil error means the
+// shutdown was clean.
+func (app *application) serve() error {
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      app.routes(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		// Errors net/http logs itself, such as TLS handshake failures, go through the
+		// same structured logger as everything else.
+		ErrorLog: slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+	}
+
+	// The admin listener is opened up front, so that a port clash stops the server from
+	// starting rather than going unnoticed.
+	var adminSrv *http.Server
+	if app.config.adminPort != 0 {
+		adminSrv = &http.Server{
+			Addr:        fmt.Sprintf(":%d", app.config.adminPort),
+			Handler:     app.adminRoutes(),
+			IdleTimeout: time.Minute,
+			ReadTimeout: 10 * time.Second,
+			ErrorLog:    srv.ErrorLog,
+		}
+
+		ln, err := net.Listen("tcp", adminSrv.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			err := adminSrv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error("admin server stopped", "error", err.Error())
+			}
+		}()
+
+		app.logger.Info("starting admin server", "addr", adminSrv.Addr)
+	}
+
+	shutdownError := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Info("shutting down server", "signal", s.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		shutdownError <- app.shutdown(ctx, srv, adminSrv)
+	}()
+
+	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
+
+	// ListenAndServe() returns http.ErrServerClosed as soon as Shutdown() is called, so
+	// that's the expected outcome; anything else means the server couldn't start.
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("stopped server", "addr", srv.Addr)
+
+	return nil
+}
+
+// shutdown stops srv and then adminSrv, which may be nil, and the background tasks. If
+// a step fails, or the grace period runs out, the remaining steps are still taken, so
+// that the background loops are always told to stop and get the chance to flush what
+// they hold. The first error is returned.
+func (app *application) shutdown(ctx context.Context, srv, adminSrv *http.Server) error {
+	// Shutdown() returns once every in-flight request has completed, or with an error if
+	// the grace period runs out first.
+	err := srv.Shutdown(ctx)
+
+	// The admin server keeps answering until the API has drained, so in-flight requests
+	// stay visible in the metrics.
+	if adminSrv != nil {
+		if adminErr := adminSrv.Shutdown(ctx); err == nil {
+			err = adminErr
+		}
+	}
+
+	app.logger.Info("completing background tasks")
+
+	close(app.done)
+
+	if waitErr := app.waitBackground(ctx); err == nil {
+		err = waitErr
+	}
+
+	return err
+}
+
+// waitBackground waits for every task started with background() to finish, or for ctx
+// to be done, whichever comes first.
+func (app *application) waitBackground(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background tasks still running after grace period: %w", ctx.Err())
+	}
+}
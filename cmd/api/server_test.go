@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWaitBackground(t *testing.T) {
+	app := newTestApplication(t)
+
+	// A panicking task must still be counted as finished.
+	app.background(func() { panic("boom") })
+
+	finished := false
+	app.background(func() {
+		time.Sleep(10 * time.Millisecond)
+		finished = true
+	})
+
+	err := app.waitBackground(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Error("waitBackground returned before the task finished")
+	}
+}
+
+func TestWaitBackgroundTimeout(t *testing.T) {
+	app := newTestApplication(t)
+
+	release := make(chan struct{})
+	defer close(release)
+	app.background(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := app.waitBackground(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v; want context.DeadlineExceeded", err)
+	}
+}
+
+func TestShutdownTimeoutStillStopsBackgroundLoops(t *testing.T) {
+	app := newTestApplication(t)
+	app.done = make(chan struct{})
+
+	// A request which outlasts the grace period.
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	stopped := false
+	app.background(func() {
+		<-app.done
+		stopped = true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = app.shutdown(ctx, srv, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v; want context.DeadlineExceeded", err)
+	}
+
+	select {
+	case <-app.done:
+	default:
+		t.Fatal("done wasn't closed")
+	}
+	app.wg.Wait()
+	if !stopped {
+		t.Error("the background loop wasn't stopped")
+	}
+}
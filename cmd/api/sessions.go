@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"backend.delmesia/internal/data"
+)
+
+// sessionActivity collects the time each session was last seen by the authenticate
+// middleware. It's flushed to the database periodically by flushSessionActivity(), so
+// that authenticated requests don't each cost a database write.
+type sessionActivity struct {
+	mu       sync.Mutex
+	lastUsed map[int64]time.Time
+}
+
+func newSessionActivity() *sessionActivity {
+	return &sessionActivity{lastUsed: make(map[int64]time.Time)}
+}
+
+func (s *sessionActivity) touch(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastUsed[id] = time.Now()
+}
+
+// drain returns the activity collected so far and starts a fresh batch.
+func (s *sessionActivity) drain() map[int64]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastUsed := s.lastUsed
+	s.lastUsed = make(map[int64]time.Time)
+	return lastUsed
+}
+
+// flushSessionActivity writes the collected session activity to the database every
+// interval. It's meant to be run in its own goroutine. When done is closed it writes out
+// whatever is left and returns.
+func (app *application) flushSessionActivity(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		stopping := false
+		select {
+		case <-ticker.C:
+		case <-done:
+			stopping = true
+		}
+
+		err := app.models.Tokens.TouchSessions(app.sessions.drain())
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		if stopping {
+			return
+		}
+	}
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	app.writeSessions(w, r, user.ID, app.contextGetSessionID(r))
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	app.deleteSession(w, r, id, user.ID)
+}
+
+// deleteOtherSessionsHandler signs the user out everywhere except for the session the
+// request was made with.
+func (app *application) deleteOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteOtherSessionsForUser(user.ID, app.contextGetSessionID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all other sessions successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminListSessionsHandler lets an administrator see any user's sessions.
+func (app *application) adminListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.writeSessions(w, r, userID, 0)
+}
+
+// adminDeleteSessionHandler lets an administrator revoke any user's session.
+func (app *application) adminDeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	id, err := app.readInt64Param(r, "session_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.deleteSession(w, r, id, userID)
+}
+
+func (app *application) writeSessions(w http.ResponseWriter, r *http.Request, userID, currentID int64) {
+	sessions, err := app.models.Tokens.GetSessionsForUser(userID, currentID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSession(w http.ResponseWriter, r *http.Request, id, userID int64) {
+	err := app.models.Tokens.DeleteSessionForUser(id, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
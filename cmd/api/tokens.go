@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend.delmesia/internal/data"
+	"backend.delmesia/internal/validator"
+)
+
+func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// TOTPCode and RecoveryCode are only needed by users who have enabled two-factor
+	// authentication. Clients find out by getting a twoFactorRequiredResponse() back.
+	var input struct {
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Refuse to even check the password while the account or client address is
+	// backing off after earlier failures. Otherwise the attempt is counted as a failure
+	// straight away, so that concurrent guesses can't all get in before the first of
+	// them is recorded, and taken back if the password turns out to be right.
+	attempt, retryAfter, err := app.startLoginAttempt(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if attempt == nil {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	// Look up the user record based on the email address. If no matching user was
+	// found, send a 401 Unauthorized response to the client.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.failedLoginResponse(w, r, attempt, nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.failedLoginResponse(w, r, attempt, user)
+		return
+	}
+
+	ok, required, err := app.checkSecondFactor(user, input.TOTPCode, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if required {
+		// The password was right, so this isn't a failure.
+		err = app.refundLoginAttempt(r, attempt)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.twoFactorRequiredResponse(w, r)
+		return
+	}
+	if !ok {
+		app.failedLoginResponse(w, r, attempt, user)
+		return
+	}
+
+	err = app.refundLoginAttempt(r, attempt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// In JWT mode, issue a signed token instead. It isn't stored anywhere, so it can't
+	// be revoked before it expires.
+	if app.jwt != nil {
+		token, expiry, err := app.jwt.Sign(strconv.FormatInt(user.ID, 10))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{"authentication_token": envelope{"token": token, "expiry": expiry}}
+
+		err = app.writeJSON(w, http.StatusCreated, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Otherwise, if the password is correct, generate a new token with a 24-hour
+	// expiry time and the scope 'authentication'. The user agent and IP address are
+	// kept so the user can tell their sessions apart.
+	userAgent := truncateUTF8(r.UserAgent(), 512)
+
+	token, err := app.models.Tokens.NewSession(user.ID, 24*time.Hour, userAgent, clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// failedLoginResponse records a failed login and sends the client a 401.
+func (app *application) failedLoginResponse(w http.ResponseWriter, r *http.Request, attempt *loginAttempt, user *data.User) {
+	err := app.recordLoginFailure(r, attempt, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidCredentialsResponse(w, r)
+}
+
+// createPasswordResetTokenHandler emails a password reset token to the given address.
+// The response is the same whether or not the address belongs to an activated user, so
+// it can't be used to find out who has an account.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if that email address belongs to an activated account, an email will be sent to it containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]any{
+				"passwordResetToken": token.Plaintext,
+			}
+
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logError(r, err)
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// jwksHandler publishes the public keys that our JWTs can be verified with, in the JSON
+// Web Key Set format. It's only routed when -auth-mode=jwt.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"keys": app.jwt.Keys.JWKS()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
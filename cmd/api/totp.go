@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"backend.delmesia/internal/data"
+	"backend.delmesia/internal/totp"
+	"backend.delmesia/internal/validator"
+)
+
+// enrollTOTPHandler starts two-factor enrolment. The response contains the otpauth://
+// URI for the user's authenticator app and a set of recovery codes, none of which can
+// be retrieved again. Two-factor authentication isn't enforced until the enrolment
+// has been confirmed with a code.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	enabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	recoveryCodes, err := totp.GenerateRecoveryCodes(10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enroll(user.ID, secret, recoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"totp": envelope{
+		"secret":         totp.Encoding.EncodeToString(secret),
+		"uri":            totp.URI(app.config.totp.issuer, user.Email, secret),
+		"recovery_codes": recoveryCodes,
+	}}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTOTPHandler completes enrolment once the user has sent a valid code from their
+// authenticator app.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	enrolment, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "two-factor authentication enrolment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if enrolment.Confirmed {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	ok, err := app.useTOTPCode(enrolment, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid or expired code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication enabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// useTOTPCode checks a code against the enrolment and, if it's valid, records its time
+// step so the code can't be used again. Using a code also confirms the enrolment.
+func (app *application) useTOTPCode(enrolment *data.TOTP, code string) (bool, error) {
+	step, ok := totp.Validate(enrolment.Secret, code, time.Now(), app.config.totp.skew, enrolment.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.TOTP.UseStep(enrolment.UserID, step)
+}
+
+// checkSecondFactor is the second step of issuing an authentication token, for users
+// who have enabled two-factor authentication. It returns required=true if the user has
+// it enabled but didn't supply a code, and ok=true if no second factor is needed or the
+// one supplied was valid. Either a TOTP code or a recovery code is accepted.
+func (app *application) checkSecondFactor(user *data.User, code, recoveryCode string) (ok, required bool, err error) {
+	enrolment, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return true, false, nil
+		}
+		return false, false, err
+	}
+
+	if !enrolment.Confirmed {
+		return true, false, nil
+	}
+
+	switch {
+	case code != "":
+		ok, err = app.useTOTPCode(enrolment, code)
+	case recoveryCode != "":
+		ok, err = app.models.TOTP.UseRecoveryCode(user.ID, recoveryCode)
+	default:
+		return false, true, nil
+	}
+
+	return ok, false, err
+}
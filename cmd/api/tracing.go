@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the request spans. Like the one in the data package, it comes from the
+// global provider, so it does nothing until newTracerProvider() has installed one.
+var tracer = otel.Tracer("backend.delmesia/cmd/api")
+
+// propagator reads the W3C traceparent and tracestate headers, so that a request's span
+// joins the caller's trace.
+var propagator = propagation.TraceContext{}
+
+// newTracerProvider creates the tracer provider for -tracing-exporter and installs it as
+// the global provider. With "none" it returns nil: spans aren't recorded, but trace IDs
+// from incoming traceparent headers still show up in logs and error responses.
+func newTracerProvider(ctx context.Context, cfg config) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch cfg.tracing.exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		// The collector is expected to run alongside the API, so the connection isn't
+		// encrypted.
+		exporter, err = otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpoint(cfg.tracing.otlpEndpoint),
+			otlptracehttp.WithInsecure(),
+		)
+	default:
+		return nil, fmt.Errorf("invalid -tracing-exporter %q", cfg.tracing.exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "greenlight"),
+			attribute.String("service.version", version),
+			attribute.String("deployment.environment", cfg.env),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider, nil
+}
+
+// traceRequest starts a span for every request, continuing the caller's trace if the
+// request has a traceparent header. Spans are named after the route pattern, which
+// instrument() has to collect, so this must run inside it.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		if route, ok := r.Context().Value(routeContextKey).(*matchedRoute); ok && route.pattern != "" {
+			span.SetName(r.Method + " " + route.pattern)
+			span.SetAttributes(attribute.String("http.route", route.pattern))
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", sr.status))
+
+		// Only server errors count as failures; a 4xx is the server doing its job.
+		if sr.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sr.status))
+		}
+	})
+}
+
+// traceID returns the ID of the trace the request belongs to, or "" if it isn't part of
+// one.
+func traceID(r *http.Request) string {
+	sc := trace.SpanContextFromContext(r.Context())
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceRequest(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+
+	original := tracer
+	tracer = provider.Tracer("test")
+	defer func() { tracer = original }()
+
+	var logs bytes.Buffer
+	app := newTestApplication(t)
+	app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	router := patternRouter{httprouter.New()}
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", func(w http.ResponseWriter, r *http.Request) {
+		app.serverErrorResponse(w, r, errors.New("boom"))
+	})
+	handler := app.instrument(app.traceRequest(router))
+
+	const (
+		callerTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		callerSpanID  = "00f067aa0ba902b7"
+	)
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies/42", nil)
+	r.Header.Set("traceparent", "00-"+callerTraceID+"-"+callerSpanID+"-01")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, r)
+
+	ended := spans.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans; want 1", len(ended))
+	}
+	span := ended[0]
+
+	if span.Name() != "GET /v1/movies/:id" {
+		t.Errorf("span name = %q; want %q", span.Name(), "GET /v1/movies/:id")
+	}
+	if got := span.SpanContext().TraceID().String(); got != callerTraceID {
+		t.Errorf("trace ID = %s; want the caller's %s", got, callerTraceID)
+	}
+	if got := span.Parent().SpanID().String(); got != callerSpanID {
+		t.Errorf("parent span ID = %s; want the caller's %s", got, callerSpanID)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("span status = %v; want Error", span.Status().Code)
+	}
+
+	var body struct {
+		TraceID string `json:"trace_id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.TraceID != callerTraceID {
+		t.Errorf("response trace_id = %q; want %q", body.TraceID, callerTraceID)
+	}
+
+	if !strings.Contains(logs.String(), `"trace_id":"`+callerTraceID+`"`) {
+		t.Errorf("error log doesn't include the trace ID:\n%s", logs.String())
+	}
+}
+
+func TestTraceIDOnlyInServerErrors(t *testing.T) {
+	app := newTestApplication(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/unknown", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("status = %d; want %d", rr.Code, http.StatusNotFound)
+	}
+	if strings.Contains(rr.Body.String(), "trace_id") {
+		t.Errorf("404 response includes a trace ID:\n%s", rr.Body.String())
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPasswordTooLong(t *testing.T) {
+	app := newTestApplication(t)
+
+	// bcrypt refuses passwords over 72 bytes, which must be reported as a validation
+	// error rather than a server error.
+	password := strings.Repeat("a", 73)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    map[string]string
+	}{
+		{"register", app.registerUserHandler, map[string]string{"name": "Alice", "email": "alice@example.com", "password": password}},
+		{"reset", app.updateUserPasswordHandler, map[string]string{"token": strings.Repeat("A", 26), "password": password}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.body)
+			rr := httptest.NewRecorder()
+
+			tt.handler(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body))))
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d; want %d\n%s", rr.Code, http.StatusUnprocessableEntity, rr.Body.String())
+			}
+
+			var response struct {
+				Error map[string]string `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if got := response.Error["password"]; got != "must not be more than 72 bytes long" {
+				t.Errorf("password error = %q", got)
+			}
+		})
+	}
+}
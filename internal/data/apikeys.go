@@ -0,0 +1,305 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/netip"
+	"strings"
+	"time"
+
+	"backend.delmesia/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// apiKeyTag starts every API key, so they're easy to recognise (and to scan for in
+// leaked source code). A full key looks like "glk_ABCDEFGH_<32 character secret>",
+// where "ABCDEFGH" is the visible prefix used to look the key up.
+const apiKeyTag = "glk_"
+
+// APIKey is a long-lived credential for machine clients. It acts on behalf of its owner,
+// but only with the permissions listed in Scopes.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Plaintext  string     `json:"key,omitempty"`
+	Hash       []byte     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	Expiry     *time.Time `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// Expired reports whether the key has passed its expiry time, if it has one.
+func (k *APIKey) Expired() bool {
+	return k.Expiry != nil && time.Now().After(*k.Expiry)
+}
+
+// AllowsIP reports whether the key may be used from addr. An empty allowlist means the
+// key can be used from anywhere.
+func (k *APIKey) AllowsIP(addr netip.Addr) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	for _, allowed := range k.AllowedIPs {
+		prefix, err := parseIPOrPrefix(allowed)
+		if err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPOrPrefix accepts either a CIDR prefix ("10.0.0.0/8") or a single address,
+// which is treated as a prefix containing just that address.
+func parseIPOrPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// ValidateAPIKey checks a new key's details. granted is the owner's current set of
+// permissions; a key can't be given a scope its owner doesn't have.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, granted Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(key.Scopes), "scopes", "must not contain duplicate values")
+	for _, scope := range key.Scopes {
+		v.Check(granted.Include(scope), "scopes", "must be a subset of your own permissions")
+	}
+
+	for _, allowed := range key.AllowedIPs {
+		_, err := parseIPOrPrefix(allowed)
+		v.Check(err == nil, "allowed_ips", "must only contain IP addresses or CIDR ranges")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// ValidateAPIKeyPlaintext checks that a key presented by a client is in the right
+// format, without touching the database.
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	prefix, secret, ok := splitAPIKey(plaintext)
+	v.Check(ok && len(prefix) == 8 && len(secret) == 32, "key", "must be a valid API key")
+}
+
+func splitAPIKey(plaintext string) (prefix, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(plaintext, apiKeyTag)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "_")
+}
+
+func generateAPIKey(key *APIKey) error {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	// 5 random bytes give an 8 character prefix, and 20 give a 32 character secret
+	// with 160 bits of entropy.
+	randomBytes := make([]byte, 25)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Prefix = encoding.EncodeToString(randomBytes[:5])
+	secret := encoding.EncodeToString(randomBytes[5:])
+
+	key.Plaintext = apiKeyTag + key.Prefix + "_" + secret
+
+	hash := sha256.Sum256([]byte(secret))
+	key.Hash = hash[:]
+
+	return nil
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Insert generates the secret for a new key and stores its hash. The plaintext is only
+// available on the returned struct, and can never be retrieved again.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	err := generateAPIKey(key)
+	if err != nil {
+		return err
+	}
+
+	if key.AllowedIPs == nil {
+		key.AllowedIPs = []string{}
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, scopes, allowed_ips, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	args := []any{
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.Hash,
+		pq.Array(key.Scopes),
+		pq.Array(key.AllowedIPs),
+		key.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser lists the keys owned by a user, newest first.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, prefix, hash, scopes, allowed_ips, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForPlaintext finds the key a client presented. The key is looked up by its
+// prefix, and the secret's hash is then compared in constant time. Unknown keys and
+// wrong secrets both return ErrRecordNotFound. Expiry and IP restrictions are left to
+// the caller.
+func (m APIKeyModel) GetForPlaintext(plaintext string) (*APIKey, error) {
+	prefix, secret, ok := splitAPIKey(plaintext)
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, user_id, name, prefix, hash, scopes, allowed_ips, expiry, last_used_at
+		FROM api_keys
+		WHERE prefix = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	key, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, prefix))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], key.Hash) != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return key, nil
+}
+
+// TouchLastUsed records that a key has just been used. To avoid a write on every request
+// from a busy client, the timestamp is only moved forward once it's more than a minute
+// old.
+func (m APIKeyModel) TouchLastUsed(id int64) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// DeleteForUser revokes one of a user's keys. If the user doesn't own a key with that
+// ID, ErrRecordNotFound is returned.
+func (m APIKeyModel) DeleteForUser(id, userID int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var key APIKey
+
+	err := row.Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		pq.Array(&key.Scopes),
+		pq.Array(&key.AllowedIPs),
+		&key.Expiry,
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
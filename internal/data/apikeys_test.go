@@ -0,0 +1,51 @@
+package data
+
+import (
+	"net/netip"
+	"testing"
+
+	"backend.delmesia/internal/validator"
+)
+
+func TestAPIKeyAllowsIP(t *testing.T) {
+	key := &APIKey{AllowedIPs: []string{"10.1.0.0/16", "192.0.2.7", "2001:db8::/32"}}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.200.3", true},
+		{"10.2.0.1", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"::ffff:192.0.2.7", true},
+		{"2001:db8::1", true},
+	}
+
+	for _, tt := range tests {
+		if got := key.AllowsIP(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("AllowsIP(%s) = %v; want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if !(&APIKey{}).AllowsIP(netip.MustParseAddr("203.0.113.1")) {
+		t.Error("a key without an allowlist should be usable from anywhere")
+	}
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	var key APIKey
+	if err := generateAPIKey(&key); err != nil {
+		t.Fatal(err)
+	}
+
+	v := validator.New()
+	if ValidateAPIKeyPlaintext(v, key.Plaintext); !v.Valid() {
+		t.Fatalf("generated key %q failed validation: %v", key.Plaintext, v.Errors)
+	}
+
+	prefix, _, _ := splitAPIKey(key.Plaintext)
+	if prefix != key.Prefix {
+		t.Errorf("prefix = %q; want %q", prefix, key.Prefix)
+	}
+}
@@ -0,0 +1,45 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Audit event names.
+const (
+	AuditAccountLocked   = "login.account_locked"
+	AuditIPLocked        = "login.ip_locked"
+	AuditAccountUnlocked = "login.account_unlocked"
+)
+
+// AuditEvent records a security-relevant event. UserID is 0 when the event isn't tied
+// to a known user, for example an IP address being locked out.
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Event     string    `json:"event"`
+	UserID    int64     `json:"user_id,omitempty"`
+	IP        string    `json:"ip"`
+	Details   string    `json:"details"`
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method appends an event to the audit log.
+func (m AuditModel) Insert(event *AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (event, user_id, ip, details)
+		VALUES ($1, NULLIF($2, 0), $3, $4)
+		RETURNING id, created_at`
+
+	args := []any{event.Event, event.UserID, event.IP, event.Details}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"backend.delmesia/internal/validator"
+)
+
+// The upstream catalogs we keep identifiers for. These are also the names of the
+// query string parameters accepted by the lookup endpoint.
+const (
+	ProviderIMDb = "imdb"
+	ProviderTMDB = "tmdb"
+	ProviderEIDR = "eidr"
+)
+
+// Providers lists every supported external ID provider.
+var Providers = []string{ProviderIMDb, ProviderTMDB, ProviderEIDR}
+
+// Regex patterns describing the format of each provider's identifiers.
+// - IMDb titles look like "tt0034583" (7 or 8 digits).
+// - TMDB movie IDs are plain positive integers.
+// - EIDR IDs are DOIs under the 10.5240 prefix, e.g. "10.5240/7791-8534-2C23-9030-8610-5".
+var (
+	IMDbRX = regexp.MustCompile(`^tt[0-9]{7,8}$`)
+	TMDBRX = regexp.MustCompile(`^[1-9][0-9]{0,9}$`)
+	EIDRRX = regexp.MustCompile(`^10\.5240/(?:[0-9A-F]{4}-){5}[0-9A-Z]$`)
+)
+
+// ExternalIDs holds the identifiers a movie is known by in other catalogs. An empty
+// string means the movie has no identifier for that provider, and is stored as NULL.
+type ExternalIDs struct {
+	IMDb string `json:"imdb,omitempty"`
+	TMDB string `json:"tmdb,omitempty"`
+	EIDR string `json:"eidr,omitempty"`
+}
+
+// DuplicateExternalIDError is returned when an external ID is already attached to
+// another movie. Provider tells the caller which identifier clashed.
+type DuplicateExternalIDError struct {
+	Provider string
+}
+
+func (e DuplicateExternalIDError) Error() string {
+	return fmt.Sprintf("duplicate %s id", e.Provider)
+}
+
+// externalIDConstraints maps the unique constraints on the movies table to the provider
+// they protect, so that a violation can be reported against the right field.
+var externalIDConstraints = map[string]string{
+	"movies_imdb_id_key": ProviderIMDb,
+	"movies_tmdb_id_key": ProviderTMDB,
+	"movies_eidr_id_key": ProviderEIDR,
+}
+
+// externalIDColumns maps a provider to its column in the movies table. Only values from
+// this map are ever interpolated into SQL.
+var externalIDColumns = map[string]string{
+	ProviderIMDb: "imdb_id",
+	ProviderTMDB: "tmdb_id",
+	ProviderEIDR: "eidr_id",
+}
+
+// ValidateExternalID checks that value is a well-formed identifier for provider.
+func ValidateExternalID(v *validator.Validator, provider, value string) {
+	key := "external_ids." + provider
+
+	switch provider {
+	case ProviderIMDb:
+		v.Check(validator.Matches(value, IMDbRX), key, "must be a valid IMDb title id (e.g. tt0034583)")
+	case ProviderTMDB:
+		v.Check(validator.Matches(value, TMDBRX), key, "must be a valid TMDB movie id")
+	case ProviderEIDR:
+		v.Check(validator.Matches(value, EIDRRX) && validEIDRCheckCharacter(value), key, "must be a valid EIDR id (e.g. 10.5240/XXXX-XXXX-XXXX-XXXX-XXXX-C)")
+	default:
+		v.AddError(provider, "is not a supported external id provider")
+	}
+}
+
+// eidrAlphabet is the character set of the EIDR check character, in value order.
+const eidrAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// validEIDRCheckCharacter reports whether the last character of an EIDR id matching
+// EIDRRX is the ISO 7064 Mod 37,36 check character for the 20 hex digits before it, so
+// that typos are caught before they reach the database.
+func validEIDRCheckCharacter(value string) bool {
+	const m = 36
+
+	suffix := strings.ReplaceAll(strings.TrimPrefix(value, "10.5240/"), "-", "")
+	digits, check := suffix[:len(suffix)-1], suffix[len(suffix)-1:]
+
+	p := m
+	for _, c := range digits {
+		s := (p + strings.IndexRune(eidrAlphabet, c)) % m
+		if s == 0 {
+			s = m
+		}
+		p = (2 * s) % (m + 1)
+	}
+
+	return eidrAlphabet[(m+1-p)%m] == check[0]
+}
+
+// ValidateExternalIDs checks every identifier that has been provided. All of them are
+// optional.
+func ValidateExternalIDs(v *validator.Validator, ids ExternalIDs) {
+	if ids.IMDb != "" {
+		ValidateExternalID(v, ProviderIMDb, ids.IMDb)
+	}
+	if ids.TMDB != "" {
+		ValidateExternalID(v, ProviderTMDB, ids.TMDB)
+	}
+	if ids.EIDR != "" {
+		ValidateExternalID(v, ProviderEIDR, ids.EIDR)
+	}
+}
@@ -0,0 +1,52 @@
+package data
+
+import (
+	"testing"
+
+	"backend.delmesia/internal/validator"
+)
+
+func TestValidateExternalID(t *testing.T) {
+	tests := []struct {
+		provider string
+		value    string
+		valid    bool
+	}{
+		{ProviderIMDb, "tt0034583", true},
+		{ProviderIMDb, "tt10872600", true},   // 8 digits, used since 2017
+		{ProviderIMDb, "tt003458", false},    // 6 digits
+		{ProviderIMDb, "tt100000000", false}, // 9 digits
+		{ProviderIMDb, "nm0000007", false},   // a person, not a title
+		{ProviderIMDb, "TT0034583", false},
+		{ProviderIMDb, "tt0034583 ", false},
+		{ProviderIMDb, "", false},
+
+		{ProviderTMDB, "289", true},
+		{ProviderTMDB, "1", true},
+		{ProviderTMDB, "9999999999", true},
+		{ProviderTMDB, "0", false},
+		{ProviderTMDB, "0289", false},
+		{ProviderTMDB, "-289", false},
+		{ProviderTMDB, "12345678901", false},
+		{ProviderTMDB, "28a", false},
+
+		{ProviderEIDR, "10.5240/7791-8534-2C23-9030-8610-5", true},
+		{ProviderEIDR, "10.5240/7791-8534-2C23-9030-8610-6", false}, // wrong check character
+		{ProviderEIDR, "10.5240/7791-8534-2C23-9030-8611-5", false}, // typo in the digits
+		{ProviderEIDR, "10.5240/7791-8534-2c23-9030-8610-5", false}, // lower case
+		{ProviderEIDR, "10.5240/7791-8534-2C23-9030-86105", false},
+		{ProviderEIDR, "10.5239/7791-8534-2C23-9030-8610-5", false}, // not the EIDR prefix
+		{ProviderEIDR, "7791-8534-2C23-9030-8610-5", false},
+
+		{"letterboxd", "casablanca", false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateExternalID(v, tt.provider, tt.value)
+
+		if v.Valid() != tt.valid {
+			t.Errorf("ValidateExternalID(%q, %q) valid = %v; want %v (errors %v)", tt.provider, tt.value, v.Valid(), tt.valid, v.Errors)
+		}
+	}
+}
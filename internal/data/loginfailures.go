@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginFailures tracks recent failed logins for a single key, which is either an
+// account ("account:<email>") or a client address ("ip:<address>").
+type LoginFailures struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// RetryAfter returns how long the client has to wait before another login attempt for
+// this key will be considered, or 0 if it may try now. While locked out that's the rest
+// of the lockout; otherwise each failure doubles the wait, starting at base and capped
+// at max.
+func (f *LoginFailures) RetryAfter(now time.Time, base, max time.Duration) time.Duration {
+	if f.LockedUntil != nil && now.Before(*f.LockedUntil) {
+		return f.LockedUntil.Sub(now)
+	}
+
+	if f.Failures == 0 {
+		return 0
+	}
+
+	backoff := base
+	for i := 1; i < f.Failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+
+	if wait := f.LastFailureAt.Add(backoff).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// The Get() method returns the failures recorded for key. A key with no failures gives
+// a zero LoginFailures rather than an error.
+func (m LoginFailureModel) Get(key string) (*LoginFailures, error) {
+	query := `
+		SELECT key, failures, last_failure_at, locked_until
+		FROM login_failures
+		WHERE key = $1`
+
+	f := LoginFailures{Key: key}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&f.Key, &f.Failures, &f.LastFailureAt, &f.LockedUntil)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// Attempt counts a login attempt against key before the password has been checked,
+// unless key is still locked out or backing off from earlier failures. It returns the
+// updated failures and true if the attempt may go ahead, or the current failures and
+// false if it may not.
+//
+// The backoff check and the count happen in one statement, which holds the row lock
+// between them, so concurrent attempts can't all be let through on the same count:
+// each one sees the attempts before it. Attempts that turn out to succeed are taken
+// back off with Refund() or Reset(). Failures older than window are forgotten.
+func (m LoginFailureModel) Attempt(key string, window, base, max time.Duration) (*LoginFailures, bool, error) {
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN login_failures.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+				ELSE login_failures.failures + 1
+			END,
+			last_failure_at = NOW()
+		WHERE (login_failures.locked_until IS NULL OR login_failures.locked_until <= NOW())
+			AND (login_failures.failures = 0
+				OR login_failures.last_failure_at + make_interval(secs => LEAST($4, $3 * power(2, login_failures.failures - 1))) <= NOW())
+		RETURNING key, failures, last_failure_at, locked_until`
+
+	f := LoginFailures{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, window.Seconds(), base.Seconds(), max.Seconds()).Scan(&f.Key, &f.Failures, &f.LastFailureAt, &f.LockedUntil)
+	switch {
+	case err == nil:
+		return &f, true, nil
+	case errors.Is(err, sql.ErrNoRows):
+		// The WHERE clause refused the update, so the key is backing off.
+		current, err := m.Get(key)
+		if err != nil {
+			return nil, false, err
+		}
+		return current, false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// Lock locks key out until the given time, and starts its failure count again from
+// zero.
+func (m LoginFailureModel) Lock(key string, until time.Time) error {
+	query := `
+		UPDATE login_failures
+		SET failures = 0, locked_until = $2
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, until)
+	return err
+}
+
+// Refund takes back an attempt counted by Attempt() which turned out not to be a
+// failure, without forgetting any earlier failures.
+func (m LoginFailureModel) Refund(key string) error {
+	query := `
+		UPDATE login_failures
+		SET failures = GREATEST(failures - 1, 0)
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// Reset forgets all failures for key and lifts any lockout, e.g. after a successful
+// login or when the account owner unlocks their account.
+func (m LoginFailureModel) Reset(key string) error {
+	query := `
+		DELETE FROM login_failures
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// DeleteExpired removes keys which no longer affect any login: their failures are older
+// than window, so Attempt() would start counting again from 1, and any lockout has
+// ended. Every email and address tried gets a row, including ones for accounts which
+// don't exist, so without this the table would grow for as long as anyone cares to
+// guess.
+func (m LoginFailureModel) DeleteExpired(window time.Duration) error {
+	query := `
+		DELETE FROM login_failures
+		WHERE last_failure_at < NOW() - make_interval(secs => $1)
+			AND (locked_until IS NULL OR locked_until <= NOW())`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, window.Seconds())
+	return err
+}
@@ -0,0 +1,91 @@
+package data
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginFailuresRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	lockedUntil := now.Add(10 * time.Minute)
+	expiredLock := now.Add(-time.Second)
+
+	tests := []struct {
+		name string
+		f    LoginFailures
+		want time.Duration
+	}{
+		{"no failures", LoginFailures{}, 0},
+		{"first failure", LoginFailures{Failures: 1, LastFailureAt: now}, time.Second},
+		{"fourth failure", LoginFailures{Failures: 4, LastFailureAt: now}, 8 * time.Second},
+		{"capped", LoginFailures{Failures: 30, LastFailureAt: now}, time.Minute},
+		{"backoff partly elapsed", LoginFailures{Failures: 3, LastFailureAt: now.Add(-3 * time.Second)}, time.Second},
+		{"backoff elapsed", LoginFailures{Failures: 3, LastFailureAt: now.Add(-time.Hour)}, 0},
+		{"locked", LoginFailures{LockedUntil: &lockedUntil}, 10 * time.Minute},
+		{"lock expired", LoginFailures{LockedUntil: &expiredLock}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.f.RetryAfter(now, time.Second, time.Minute); got != tt.want {
+				t.Errorf("RetryAfter() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttemptChecksAndCountsInOneStatement(t *testing.T) {
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	// The recorder returns no rows, which is what PostgreSQL does when the backoff
+	// check refuses the update.
+	f, ok, err := LoginFailureModel{DB: db}.Attempt("ip:192.0.2.1", time.Hour, time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Attempt() allowed an attempt the database refused")
+	}
+	if f == nil || f.Key != "ip:192.0.2.1" {
+		t.Errorf("Attempt() returned %+v; want the current failures for the key", f)
+	}
+
+	if len(rec.statements) == 0 {
+		t.Fatal("no statements were run")
+	}
+	s := rec.statements[0]
+	for _, want := range []string{"INSERT INTO login_failures", "ON CONFLICT", "locked_until <= NOW()", "make_interval", "RETURNING"} {
+		if !strings.Contains(s.query, want) {
+			t.Errorf("first statement doesn't include %q:\n%s", want, s.query)
+		}
+	}
+	if len(s.args) != 4 || s.args[1] != 3600.0 || s.args[2] != 1.0 || s.args[3] != 60.0 {
+		t.Errorf("args = %v; want [key 3600 1 60]", s.args)
+	}
+}
+
+func TestDeleteExpiredKeepsLockouts(t *testing.T) {
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	err := LoginFailureModel{DB: db}.DeleteExpired(15 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.statements) != 1 {
+		t.Fatalf("ran %d statements; want 1", len(rec.statements))
+	}
+	s := rec.statements[0]
+	if !strings.Contains(s.query, "DELETE FROM login_failures") || !strings.Contains(s.query, "locked_until <= NOW()") {
+		t.Errorf("query doesn't spare current lockouts:\n%s", s.query)
+	}
+	if len(s.args) != 1 || s.args[0] != float64(900) {
+		t.Errorf("args = %v; want [900]", s.args)
+	}
+}
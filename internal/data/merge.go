@@ -0,0 +1,139 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"backend.delmesia/internal/validator"
+)
+
+// MergeMovies folds source into target in memory, ready to be saved with Merge(). Genres
+// are unioned (keeping target's order first) and any external ID missing from target is
+// taken from source. Problems that would stop the merge, such as ending up with more
+// than 5 genres or the two movies carrying different IDs for the same provider, are
+// recorded in v.
+func MergeMovies(v *validator.Validator, target, source *Movie) {
+	genres := append([]string{}, target.Genres...)
+	for _, genre := range source.Genres {
+		if !validator.PermittedValue(genre, genres...) {
+			genres = append(genres, genre)
+		}
+	}
+	v.Check(len(genres) <= 5, "genres", "merged movie must not contain more than 5 genres")
+	target.Genres = genres
+
+	mergeExternalID(v, ProviderIMDb, &target.ExternalIDs.IMDb, source.ExternalIDs.IMDb)
+	mergeExternalID(v, ProviderTMDB, &target.ExternalIDs.TMDB, source.ExternalIDs.TMDB)
+	mergeExternalID(v, ProviderEIDR, &target.ExternalIDs.EIDR, source.ExternalIDs.EIDR)
+}
+
+func mergeExternalID(v *validator.Validator, provider string, target *string, source string) {
+	switch {
+	case source == "":
+	case *target == "":
+		*target = source
+	case *target != source:
+		v.AddError("external_ids."+provider, "differs between the two movies")
+	}
+}
+
+// Merge saves a target movie produced by MergeMovies() and retires the source movie, all
+// in one transaction. The source's ID is recorded as an alias of the target (as is any
+// alias which used to point at the source), so old URLs keep resolving, and the source
+// row is then deleted. The target is only updated if its version hasn't changed since it
+// was read, otherwise ErrEditConflict is returned.
+func (m MovieModel) Merge(target *Movie, sourceID int64) error {
+	if err := m.checkScope(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	q := tracedQueryer{tx}
+
+	// Make sure the source belongs to this organization before touching its aliases.
+	// Locking the row also stops it being merged into two targets at once.
+	var exists bool
+	err = q.QueryRowContext(ctx, `SELECT true FROM movies WHERE id = $1 AND organization_id = $2 FOR UPDATE`, sourceID, m.OrganizationID).Scan(&exists)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	// Re-point any aliases of the source first, since deleting the source would
+	// otherwise cascade to them.
+	_, err = q.ExecContext(ctx, `UPDATE movie_aliases SET movie_id = $1 WHERE movie_id = $2`, target.ID, sourceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, `INSERT INTO movie_aliases (alias_id, movie_id) VALUES ($1, $2)`, sourceID, target.ID)
+	if err != nil {
+		return err
+	}
+
+	// Deleting the source before updating the target frees up its external IDs, which
+	// would otherwise trip the unique constraints when they're copied across.
+	result, err := q.ExecContext(ctx, `DELETE FROM movies WHERE id = $1 AND organization_id = $2`, sourceID, m.OrganizationID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = updateMovie(ctx, q, m.OrganizationID, target)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAlias returns the ID of the movie that a merged-away movie ID now refers to. If id
+// was never merged, ErrRecordNotFound is returned.
+func (m MovieModel) GetAlias(id int64) (int64, error) {
+	if err := m.checkScope(); err != nil {
+		return 0, err
+	}
+
+	query := `
+		SELECT movie_aliases.movie_id
+		FROM movie_aliases
+		INNER JOIN movies ON movies.id = movie_aliases.movie_id
+		WHERE movie_aliases.alias_id = $1 AND movies.organization_id = $2`
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	var movieID int64
+	err := m.db().QueryRowContext(ctx, query, id, m.OrganizationID).Scan(&movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return movieID, nil
+}
@@ -0,0 +1,52 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+
+	"backend.delmesia/internal/validator"
+)
+
+func TestMergeMovies(t *testing.T) {
+	target := &Movie{
+		Genres:      []string{"drama", "romance"},
+		ExternalIDs: ExternalIDs{IMDb: "tt0034583"},
+	}
+	source := &Movie{
+		Genres:      []string{"romance", "war"},
+		ExternalIDs: ExternalIDs{IMDb: "tt0034583", TMDB: "289"},
+	}
+
+	v := validator.New()
+	MergeMovies(v, target, source)
+
+	if !v.Valid() {
+		t.Fatalf("unexpected validation errors: %v", v.Errors)
+	}
+	if want := []string{"drama", "romance", "war"}; !reflect.DeepEqual(target.Genres, want) {
+		t.Errorf("genres = %v; want %v", target.Genres, want)
+	}
+	if want := (ExternalIDs{IMDb: "tt0034583", TMDB: "289"}); target.ExternalIDs != want {
+		t.Errorf("external ids = %+v; want %+v", target.ExternalIDs, want)
+	}
+}
+
+func TestMergeMoviesConflicts(t *testing.T) {
+	target := &Movie{
+		Genres:      []string{"a", "b", "c"},
+		ExternalIDs: ExternalIDs{EIDR: "10.5240/7791-8534-2C23-9030-8610-5"},
+	}
+	source := &Movie{
+		Genres:      []string{"d", "e", "f"},
+		ExternalIDs: ExternalIDs{EIDR: "10.5240/0000-0000-0000-0000-0000-X"},
+	}
+
+	v := validator.New()
+	MergeMovies(v, target, source)
+
+	for _, key := range []string{"genres", "external_ids.eidr"} {
+		if _, ok := v.Errors[key]; !ok {
+			t.Errorf("expected a validation error for %q; got %v", key, v.Errors)
+		}
+	}
+}
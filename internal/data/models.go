@@ -3,24 +3,54 @@ package data
 import (
 	"database/sql"
 	"errors"
+
+	"github.com/lib/pq"
 )
 
 // A custom ErrRecordNotFound error that will be used by the Get() method
 // when looking up a movie that doesn't exist in the database.
+// ErrEditConflict is returned when a record was changed by someone else between
+// being read and being written back.
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// isUniqueViolation reports whether err is a PostgreSQL unique_violation (23505) of the
+// named constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
 // This will wrap the MovieModel. This is optional, but as the build progresses,
 // this can used to add models like UserModel and PermissionModel
 type Models struct {
-	Movies MovieModel
+	APIKeys       APIKeyModel
+	Audit         AuditModel
+	LoginFailures LoginFailureModel
+	Movies        MovieModel
+	Organizations OrganizationModel
+	Permissions   PermissionModel
+	RateLimits    RateLimitModel
+	TOTP          TOTPModel
+	Tokens        TokenModel
+	Users         UserModel
 }
 
 // For ease of use, NewModels() method will return a Models struct containing the
 // initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies: MovieModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Organizations: OrganizationModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		RateLimits:    RateLimitModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Users:         UserModel{DB: db},
 	}
 }
@@ -1,12 +1,19 @@
 package data
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"backend.delmesia/internal/validator"
 
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Movie represents a movie with its attributes.
@@ -16,13 +23,16 @@ import (
 // - "-" directive is used in struct tags to hide information that users don't need to see.
 // - "omitempty" directive can hide fields if and only if they are empty.
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID             int64       `json:"id"`
+	CreatedAt      time.Time   `json:"-"`
+	OrganizationID int64       `json:"organization_id"`
+	CreatedBy      int64       `json:"created_by,omitempty"`
+	Title          string      `json:"title"`
+	Year           int32       `json:"year,omitempty"`
+	Runtime        Runtime     `json:"runtime,omitempty"`
+	Genres         []string    `json:"genres,omitempty"`
+	ExternalIDs    ExternalIDs `json:"external_ids"`
+	Version        int32       `json:"version"`
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -44,38 +54,462 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// Note that it's using the unique helper to check that all values in the input.Genres
 	// slices are unique.
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+
+	ValidateExternalIDs(v, movie.ExternalIDs)
 }
 
+// ErrNoOrganization is returned by MovieModel methods called on a model which hasn't
+// been scoped to an organization with ForOrganization().
+var ErrNoOrganization = errors.New("movie model is not scoped to an organization")
+
 // A struct type which wraps a sql.DB connection pool.
+//
+// Every catalog belongs to an organization, and every query the model runs is restricted
+// to OrganizationID, so one tenant can never read or change another tenant's movies. The
+// unscoped model in Models refuses to do anything until ForOrganization() is called.
 type MovieModel struct {
-	DB *sql.DB
+	DB             *sql.DB
+	OrganizationID int64
+
+	// ctx carries the trace that queries are recorded in. See WithContext().
+	ctx context.Context
+}
+
+// ForOrganization returns a copy of the model restricted to one organization's catalog.
+func (m MovieModel) ForOrganization(id int64) MovieModel {
+	m.OrganizationID = id
+	return m
+}
+
+// WithContext returns a copy of the model whose queries are traced as children of the
+// span in ctx, usually the one for the HTTP request. Only the trace is taken from ctx:
+// queries keep their own timeouts, and aren't cancelled along with it.
+func (m MovieModel) WithContext(ctx context.Context) MovieModel {
+	m.ctx = ctx
+	return m
+}
+
+// baseContext is the parent of each query's timeout context.
+func (m MovieModel) baseContext() context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(m.ctx))
+}
+
+// db returns the connection pool, with every statement traced.
+func (m MovieModel) db() queryer {
+	return tracedQueryer{m.DB}
+}
+
+func (m MovieModel) checkScope() error {
+	if m.OrganizationID < 1 {
+		return ErrNoOrganization
+	}
+	return nil
 }
 
 // The Insert() method accepts a pointer to a movie struct, which should contain the data
-// for the new record.
+// for the new record. CreatedBy should be set to the ID of the user adding the movie;
+// zero records no owner.
 func (m MovieModel) Insert(movie *Movie) error {
+	if err := m.checkScope(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	return insertMovie(ctx, m.db(), m.OrganizationID, movie)
+}
+
+func insertMovie(ctx context.Context, q queryer, organizationID int64, movie *Movie) error {
 	// The SQL query for inserting a new record in the movies table and returning
-	// the system-generated data.
+	// the system-generated data. Empty external IDs are stored as NULL so that the
+	// unique constraints only apply to identifiers which have actually been set.
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3)
+		INSERT INTO movies (organization_id, created_by, title, year, runtime, genres, imdb_id, tmdb_id, eidr_id)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''))
 		RETURNING id, created_at, version`
 	// args will contain the values for the placeholder parameters from the movie struct.
 	// Declaring slice immediately next to the SQL query helps to make it nice and clear in the query.
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{
+		organizationID,
+		movie.CreatedBy,
+		movie.Title,
+		movie.Year,
+		movie.Runtime,
+		pq.Array(movie.Genres),
+		movie.ExternalIDs.IMDb,
+		movie.ExternalIDs.TMDB,
+		movie.ExternalIDs.EIDR,
+	}
 
-	return m.DB.QueryRow(query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return mapExternalIDError(err)
+	}
+	movie.OrganizationID = organizationID
+	return nil
 }
 
+// The Get() method fetches a specific record from the movies table. If no matching
+// record exists, ErrRecordNotFound is returned.
 func (m MovieModel) Get(id int64) (*Movie, error) {
-	return nil, nil
+	if err := m.checkScope(); err != nil {
+		return nil, err
+	}
+
+	// PostgreSQL bigserial starts auto-incrementing at 1 by default, so there's no point
+	// looking up IDs below that.
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
 
+	query := `
+		SELECT ` + movieColumns + `
+		FROM movies
+		WHERE id = $1 AND organization_id = $2`
+
+	return m.getOne(query, id, m.OrganizationID)
 }
 
+// GetByExternalID fetches the movie carrying the given identifier from an upstream
+// catalog, e.g. GetByExternalID(ProviderIMDb, "tt0034583").
+func (m MovieModel) GetByExternalID(provider, value string) (*Movie, error) {
+	if err := m.checkScope(); err != nil {
+		return nil, err
+	}
+
+	column, ok := externalIDColumns[provider]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	// column comes from a fixed map above, so it's safe to interpolate it here.
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM movies
+		WHERE %s = $1 AND organization_id = $2`, movieColumns, column)
+
+	return m.getOne(query, value, m.OrganizationID)
+}
+
+// NormalizeTitle lower-cases title and collapses any run of punctuation or whitespace
+// into a single space, so "Casablanca!" and "casablanca" normalise to the same string.
+// It mirrors the expression behind the movies.title_normalized column.
+func NormalizeTitle(title string) string {
+	var b strings.Builder
+	space := false
+
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+			continue
+		}
+		space = true
+	}
+
+	return b.String()
+}
+
+// FindDuplicates returns movies from the same year whose normalised title (see
+// NormalizeTitle()) matches the given title.
+//
+// If similarity is greater than zero, titles whose pg_trgm similarity to the normalised
+// title is at least that value are also returned. This requires the pg_trgm extension.
+func (m MovieModel) FindDuplicates(title string, year int32, similarity float64) ([]*Movie, error) {
+	if err := m.checkScope(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	// The similarity threshold is set for the duration of a transaction, so that it
+	// can't leak into other queries run on the same pooled connection.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	movies, err := findDuplicates(ctx, tracedQueryer{tx}, m.OrganizationID, title, year, similarity)
+	if err != nil {
+		return nil, err
+	}
+
+	return movies, tx.Commit()
+}
+
+// InsertUnlessDuplicate inserts movie, like Insert(), unless FindDuplicates() finds
+// possible duplicates of it, in which case they're returned and nothing is inserted.
+// Concurrent calls for the same organization and year are serialised, so two clients
+// creating the same film at once can't both get past the check.
+func (m MovieModel) InsertUnlessDuplicate(movie *Movie, similarity float64) ([]*Movie, error) {
+	if err := m.checkScope(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := tracedQueryer{tx}
+
+	// The lock is released when the transaction ends. Fuzzy matches can have any title,
+	// so the lock covers the whole year rather than one normalised title.
+	lockKey := fmt.Sprintf("movies:%d:%d", m.OrganizationID, movie.Year)
+	_, err = q.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, lockKey)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := findDuplicates(ctx, q, m.OrganizationID, movie.Title, movie.Year, similarity)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+
+	err = insertMovie(ctx, q, m.OrganizationID, movie)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, tx.Commit()
+}
+
+// findDuplicates runs the FindDuplicates() query. With a similarity, it must be called
+// inside a transaction.
+func findDuplicates(ctx context.Context, q queryer, organizationID int64, title string, year int32, similarity float64) ([]*Movie, error) {
+	match := "title_normalized = $3"
+	args := []any{organizationID, year, NormalizeTitle(title)}
+
+	if similarity > 0 {
+		// similarity() >= x can't use the trigram index, but the % operator can. It
+		// matches titles at least pg_trgm.similarity_threshold alike, so the threshold
+		// is set for this transaction first. The similarity() check is then exact.
+		_, err := q.ExecContext(ctx, `SELECT set_config('pg_trgm.similarity_threshold', $1, true)`, strconv.FormatFloat(similarity, 'f', -1, 64))
+		if err != nil {
+			return nil, err
+		}
+
+		match = "(title_normalized = $3 OR (title_normalized % $3 AND similarity(title_normalized, $3) >= $4))"
+		args = append(args, similarity)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM movies
+		WHERE organization_id = $1 AND year = $2 AND %s
+		ORDER BY id
+		LIMIT 10`, movieColumns, match)
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	for rows.Next() {
+		movie, err := scanMovie(rows)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// movieColumns is the select list matching the order scanMovie() expects.
+const movieColumns = `id, created_at, organization_id, COALESCE(created_by, 0), title, year, runtime, genres,
+			COALESCE(imdb_id, ''), COALESCE(tmdb_id, ''), COALESCE(eidr_id, ''), version`
+
+// getOne runs a query returning a single row of movie columns and scans it into a Movie.
+func (m MovieModel) getOne(query string, args ...any) (*Movie, error) {
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	movie, err := scanMovie(m.db().QueryRowContext(ctx, query, args...))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return movie, nil
+}
+
+// scanMovie reads a row selected with movieColumns. Both *sql.Row and *sql.Rows
+// satisfy the interface.
+func scanMovie(row interface{ Scan(...any) error }) (*Movie, error) {
+	var movie Movie
+
+	err := row.Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.OrganizationID,
+		&movie.CreatedBy,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.ExternalIDs.IMDb,
+		&movie.ExternalIDs.TMDB,
+		&movie.ExternalIDs.EIDR,
+		&movie.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &movie, nil
+}
+
+// The Update() method writes the editable fields of movie back to the database. The
+// update only succeeds if the version number still matches the one that was read, which
+// prevents two clients from silently overwriting each other's changes. On success the
+// movie's version number is bumped; otherwise ErrEditConflict is returned.
 func (m MovieModel) Update(movie *Movie) error {
+	if err := m.checkScope(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	return updateMovie(ctx, m.db(), m.OrganizationID, movie)
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx, so the same query can be run
+// inside or outside a transaction.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func updateMovie(ctx context.Context, db queryRower, organizationID int64, movie *Movie) error {
+	query := `
+		UPDATE movies
+		SET title = $1, year = $2, runtime = $3, genres = $4,
+			imdb_id = NULLIF($5, ''), tmdb_id = NULLIF($6, ''), eidr_id = NULLIF($7, ''),
+			version = version + 1
+		WHERE id = $8 AND version = $9 AND organization_id = $10
+		RETURNING version`
+
+	args := []any{
+		movie.Title,
+		movie.Year,
+		movie.Runtime,
+		pq.Array(movie.Genres),
+		movie.ExternalIDs.IMDb,
+		movie.ExternalIDs.TMDB,
+		movie.ExternalIDs.EIDR,
+		movie.ID,
+		movie.Version,
+		organizationID,
+	}
+
+	err := db.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return mapExternalIDError(err)
+		}
+	}
+
 	return nil
 }
 
+// SetOwner hands a movie over to another user, who becomes able to edit it as if they
+// had created it. If there's no such movie, ErrRecordNotFound is returned.
+func (m MovieModel) SetOwner(id, userID int64) error {
+	if err := m.checkScope(); err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE movies
+		SET created_by = $1, version = version + 1
+		WHERE id = $2 AND organization_id = $3`
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, query, userID, id, m.OrganizationID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// The Delete() method removes a movie, along with any aliases pointing at it. If there's
+// no such movie, ErrRecordNotFound is returned.
 func (m MovieModel) Delete(id int64) error {
+	if err := m.checkScope(); err != nil {
+		return err
+	}
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM movies
+		WHERE id = $1 AND organization_id = $2`
+
+	ctx, cancel := context.WithTimeout(m.baseContext(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, query, id, m.OrganizationID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
 	return nil
 }
+
+// mapExternalIDError converts a unique constraint violation on one of the external ID
+// columns into a DuplicateExternalIDError. Any other error is returned unchanged.
+func mapExternalIDError(err error) error {
+	for constraint, provider := range externalIDConstraints {
+		if isUniqueViolation(err, constraint) {
+			return DuplicateExternalIDError{Provider: provider}
+		}
+	}
+	return err
+}
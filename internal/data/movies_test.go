@@ -0,0 +1,311 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recorder is a minimal database/sql driver which remembers every statement it's asked
+// to run instead of talking to PostgreSQL. Queries return no rows, except for the
+// SELECT ... FOR UPDATE used to lock a movie, which returns a single row so that Merge()
+// carries on far enough to be checked, and queries containing one of the keys of rows,
+// which return that row.
+type recorder struct {
+	mu         sync.Mutex
+	statements []statement
+	rows       map[string][]driver.Value
+}
+
+type statement struct {
+	query string
+	args  []driver.Value
+}
+
+func (rec *recorder) record(query string, args []driver.NamedValue) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	s := statement{query: query}
+	for _, arg := range args {
+		s.args = append(s.args, arg.Value)
+	}
+	rec.statements = append(rec.statements, s)
+}
+
+func (rec *recorder) Connect(context.Context) (driver.Conn, error) { return recorderConn{rec}, nil }
+func (rec *recorder) Driver() driver.Driver                        { return nil }
+
+type recorderConn struct{ rec *recorder }
+
+func (c recorderConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("recorder: prepared statements are not supported")
+}
+func (c recorderConn) Close() error              { return nil }
+func (c recorderConn) Begin() (driver.Tx, error) { return recorderTx{}, nil }
+
+func (c recorderConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.rec.record(query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c recorderConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.rec.record(query, args)
+	if strings.Contains(query, "FOR UPDATE") {
+		return &recorderRows{values: [][]driver.Value{{true}}}, nil
+	}
+	for match, row := range c.rec.rows {
+		if strings.Contains(query, match) {
+			return &recorderRows{values: [][]driver.Value{row}}, nil
+		}
+	}
+	return &recorderRows{}, nil
+}
+
+type recorderTx struct{}
+
+func (recorderTx) Commit() error   { return nil }
+func (recorderTx) Rollback() error { return nil }
+
+type recorderRows struct{ values [][]driver.Value }
+
+// Columns only needs to have the right length, which database/sql checks against the
+// destinations passed to Scan().
+func (r *recorderRows) Columns() []string {
+	if len(r.values) == 0 {
+		return []string{"exists"}
+	}
+	return make([]string, len(r.values[0]))
+}
+
+func (r *recorderRows) Close() error { return nil }
+
+func (r *recorderRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// movieOperations calls every MovieModel method once. Errors are returned so callers
+// can check them, but the recorder never finds any movies so most calls fail.
+var movieOperations = map[string]func(m MovieModel) error{
+	"Insert": func(m MovieModel) error {
+		return m.Insert(&Movie{CreatedBy: 3, Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}})
+	},
+	"Get": func(m MovieModel) error {
+		_, err := m.Get(1)
+		return err
+	},
+	"GetByExternalID": func(m MovieModel) error {
+		_, err := m.GetByExternalID(ProviderIMDb, "tt0034583")
+		return err
+	},
+	"FindDuplicates": func(m MovieModel) error {
+		_, err := m.FindDuplicates("Casablanca", 1942, 0.5)
+		return err
+	},
+	"InsertUnlessDuplicate": func(m MovieModel) error {
+		_, err := m.InsertUnlessDuplicate(&Movie{CreatedBy: 3, Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}}, 0.5)
+		return err
+	},
+	"Update": func(m MovieModel) error {
+		return m.Update(&Movie{ID: 1, Title: "Casablanca", Version: 1})
+	},
+	"Merge": func(m MovieModel) error {
+		return m.Merge(&Movie{ID: 1, Title: "Casablanca", Version: 1}, 2)
+	},
+	"SetOwner": func(m MovieModel) error {
+		return m.SetOwner(1, 3)
+	},
+	"Delete": func(m MovieModel) error {
+		return m.Delete(1)
+	},
+	"GetAlias": func(m MovieModel) error {
+		_, err := m.GetAlias(2)
+		return err
+	},
+}
+
+// touchesMovies matches statements which read or write the movies table itself.
+var touchesMovies = regexp.MustCompile(`(?i)(FROM|INTO|UPDATE|JOIN)\s+movies\b`)
+
+var (
+	insertOrganizationRX = regexp.MustCompile(`INSERT INTO movies \(organization_id,`)
+	whereOrganizationRX  = regexp.MustCompile(`organization_id = \$(\d+)`)
+)
+
+// organizationArg returns the value bound to a statement's organization_id, either as
+// the first column of an INSERT or in an "organization_id = $n" condition.
+func organizationArg(s statement) (driver.Value, bool) {
+	n := 1
+	if !insertOrganizationRX.MatchString(s.query) {
+		match := whereOrganizationRX.FindStringSubmatch(s.query)
+		if match == nil {
+			return nil, false
+		}
+		n, _ = strconv.Atoi(match[1])
+	}
+	if n < 1 || n > len(s.args) {
+		return nil, false
+	}
+	return s.args[n-1], true
+}
+
+func TestMovieModelIsScopedToOrganization(t *testing.T) {
+	const organizationID = 7
+
+	for name, op := range movieOperations {
+		t.Run(name, func(t *testing.T) {
+			rec := &recorder{}
+			db := sql.OpenDB(rec)
+			defer db.Close()
+
+			m := MovieModel{DB: db}.ForOrganization(organizationID)
+			op(m)
+
+			if len(rec.statements) == 0 {
+				t.Fatal("no statements were run")
+			}
+
+			for _, s := range rec.statements {
+				if !touchesMovies.MatchString(s.query) {
+					continue
+				}
+				if arg, ok := organizationArg(s); !ok || arg != int64(organizationID) {
+					t.Errorf("statement is not restricted to organization %d (args %v):\n%s", organizationID, s.args, s.query)
+				}
+			}
+		})
+	}
+}
+
+func TestMovieModelRequiresOrganization(t *testing.T) {
+	for name, op := range movieOperations {
+		t.Run(name, func(t *testing.T) {
+			rec := &recorder{}
+			db := sql.OpenDB(rec)
+			defer db.Close()
+
+			err := op(MovieModel{DB: db})
+			if !errors.Is(err, ErrNoOrganization) {
+				t.Errorf("err = %v; want ErrNoOrganization", err)
+			}
+			if len(rec.statements) != 0 {
+				t.Errorf("unscoped model ran %d statements", len(rec.statements))
+			}
+		})
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	tests := map[string]string{
+		"Casablanca":             "casablanca",
+		"CASABLANCA!":            "casablanca",
+		"  Casablanca  ":         "casablanca",
+		"Mission: Impossible":    "mission impossible",
+		"Mission -- Impossible":  "mission impossible",
+		"Léon: The Professional": "léon the professional",
+		"2001: A Space Odyssey":  "2001 a space odyssey",
+		"Se7en":                  "se7en",
+		"WALL·E":                 "wall e",
+		"...":                    "",
+		"":                       "",
+	}
+
+	for title, want := range tests {
+		if got := NormalizeTitle(title); got != want {
+			t.Errorf("NormalizeTitle(%q) = %q; want %q", title, got, want)
+		}
+	}
+}
+
+func TestFindDuplicatesQuery(t *testing.T) {
+	t.Run("exact", func(t *testing.T) {
+		rec := &recorder{}
+		db := sql.OpenDB(rec)
+		defer db.Close()
+
+		_, err := MovieModel{DB: db}.ForOrganization(7).FindDuplicates("Casablanca!", 1942, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rec.statements) != 1 {
+			t.Fatalf("got %d statements; want 1", len(rec.statements))
+		}
+		s := rec.statements[0]
+		if !strings.Contains(s.query, "title_normalized = $3") || strings.Contains(s.query, "similarity") {
+			t.Errorf("unexpected query:\n%s", s.query)
+		}
+		if s.args[2] != "casablanca" {
+			t.Errorf("title argument = %v; want the normalised title", s.args[2])
+		}
+	})
+
+	t.Run("similar", func(t *testing.T) {
+		rec := &recorder{}
+		db := sql.OpenDB(rec)
+		defer db.Close()
+
+		_, err := MovieModel{DB: db}.ForOrganization(7).FindDuplicates("Casablanca", 1942, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rec.statements) != 2 {
+			t.Fatalf("got %d statements; want 2", len(rec.statements))
+		}
+
+		// The threshold has to be set, transaction-locally, before the query that uses
+		// the indexable % operator.
+		set := rec.statements[0]
+		if !strings.Contains(set.query, "set_config('pg_trgm.similarity_threshold', $1, true)") || set.args[0] != "0.5" {
+			t.Errorf("unexpected threshold statement %q with args %v", set.query, set.args)
+		}
+
+		s := rec.statements[1]
+		if !strings.Contains(s.query, "title_normalized % $3") || !strings.Contains(s.query, "similarity(title_normalized, $3) >= $4") {
+			t.Errorf("unexpected query:\n%s", s.query)
+		}
+		if s.args[3] != 0.5 {
+			t.Errorf("similarity argument = %v; want 0.5", s.args[3])
+		}
+	})
+}
+
+func TestInsertUnlessDuplicateLocksBeforeChecking(t *testing.T) {
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	movie := &Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}}
+	MovieModel{DB: db}.ForOrganization(7).InsertUnlessDuplicate(movie, 0)
+
+	var got []string
+	for _, s := range rec.statements {
+		got = append(got, strings.Fields(s.query)[0]+" "+strings.Fields(s.query)[1])
+	}
+
+	want := []string{"SELECT pg_advisory_xact_lock(hashtextextended($1,", "SELECT id,", "INSERT INTO"}
+	if len(got) != len(want) {
+		t.Fatalf("statements = %q; want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d = %q; want %q", i, got[i], want[i])
+		}
+	}
+	if key := rec.statements[0].args[0]; key != "movies:7:1942" {
+		t.Errorf("lock key = %v; want movies:7:1942", key)
+	}
+}
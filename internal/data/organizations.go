@@ -0,0 +1,213 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"backend.delmesia/internal/validator"
+)
+
+// Membership roles, from most to least powerful. Owners and admins can manage an
+// organization's members; everyone can work with its catalog, subject to their
+// permissions.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// ErrDuplicateSlug is returned when creating an organization whose slug is taken, and
+// ErrDuplicateMembership when adding a user to an organization they already belong to.
+var (
+	ErrDuplicateSlug       = errors.New("duplicate slug")
+	ErrDuplicateMembership = errors.New("duplicate membership")
+)
+
+// SlugRX matches lower-case, hyphen separated slugs such as "home-video".
+var SlugRX = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Organization is a tenant, owning its own movie catalog.
+type Organization struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+}
+
+// Membership records a user's role in an organization.
+type Membership struct {
+	Organization *Organization `json:"organization"`
+	UserID       int64         `json:"-"`
+	Role         string        `json:"role"`
+}
+
+// CanManageMembers reports whether the member may add people to the organization.
+func (m *Membership) CanManageMembers() bool {
+	return m.Role == RoleOwner || m.Role == RoleAdmin
+}
+
+// CanManageCatalog reports whether the member may manage the organization's catalog as a
+// whole, such as handing movies over to other members.
+func (m *Membership) CanManageCatalog() bool {
+	return m.Role == RoleOwner || m.Role == RoleAdmin
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "name", "must be provided")
+	v.Check(len(org.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(org.Slug != "", "slug", "must be provided")
+	v.Check(len(org.Slug) <= 50, "slug", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(org.Slug, SlugRX), "slug", "must only contain lower-case letters, digits and hyphens")
+}
+
+func ValidateRole(v *validator.Validator, role string) {
+	v.Check(validator.PermittedValue(role, RoleOwner, RoleAdmin, RoleMember), "role", "must be one of owner, admin or member")
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type OrganizationModel struct {
+	DB *sql.DB
+}
+
+// Insert creates an organization and makes ownerID its owner, in one transaction.
+func (m OrganizationModel) Insert(org *Organization, ownerID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO organizations (name, slug)
+		VALUES ($1, $2)
+		RETURNING id, created_at`
+
+	err = tx.QueryRowContext(ctx, query, org.Name, org.Slug).Scan(&org.ID, &org.CreatedAt)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "organizations_slug_key"):
+			return ErrDuplicateSlug
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO organization_memberships (organization_id, user_id, role)
+		VALUES ($1, $2, $3)`, org.ID, ownerID, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForUser lists the organizations a user belongs to, along with their role in
+// each, oldest organization first.
+func (m OrganizationModel) GetAllForUser(userID int64) ([]*Membership, error) {
+	query := `
+		SELECT organizations.id, organizations.created_at, organizations.name, organizations.slug,
+			organization_memberships.user_id, organization_memberships.role
+		FROM organizations
+		INNER JOIN organization_memberships ON organization_memberships.organization_id = organizations.id
+		WHERE organization_memberships.user_id = $1
+		ORDER BY organizations.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*Membership{}
+	for rows.Next() {
+		membership, err := scanMembership(rows)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return memberships, nil
+}
+
+// GetMembership returns a user's membership of one organization. If the organization
+// doesn't exist or the user isn't a member, ErrRecordNotFound is returned; the two cases
+// are deliberately indistinguishable.
+func (m OrganizationModel) GetMembership(organizationID, userID int64) (*Membership, error) {
+	query := `
+		SELECT organizations.id, organizations.created_at, organizations.name, organizations.slug,
+			organization_memberships.user_id, organization_memberships.role
+		FROM organizations
+		INNER JOIN organization_memberships ON organization_memberships.organization_id = organizations.id
+		WHERE organizations.id = $1 AND organization_memberships.user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	membership, err := scanMembership(m.DB.QueryRowContext(ctx, query, organizationID, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return membership, nil
+}
+
+// AddMember adds a user to an organization with the given role.
+func (m OrganizationModel) AddMember(organizationID, userID int64, role string) error {
+	query := `
+		INSERT INTO organization_memberships (organization_id, user_id, role)
+		VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, organizationID, userID, role)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "organization_memberships_pkey"):
+			return ErrDuplicateMembership
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanMembership(row interface{ Scan(...any) error }) (*Membership, error) {
+	membership := Membership{Organization: &Organization{}}
+
+	err := row.Scan(
+		&membership.Organization.ID,
+		&membership.Organization.CreatedAt,
+		&membership.Organization.Name,
+		&membership.Organization.Slug,
+		&membership.UserID,
+		&membership.Role,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &membership, nil
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+// RateLimitWindow holds the request counts for one key in the current fixed window and
+// the one before it. Weighting the previous window by how much of it still overlaps the
+// last Length of time gives a sliding window estimate, without having to store a
+// timestamp for every request.
+type RateLimitWindow struct {
+	Key      string
+	Start    time.Time
+	Length   time.Duration
+	Current  int
+	Previous int
+	// Now is the database's clock when the counts were read.
+	Now time.Time
+}
+
+// Estimate returns the approximate number of requests made in the Length of time
+// leading up to now.
+func (w *RateLimitWindow) Estimate(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(w.Start))/float64(w.Length)
+	if overlap < 0 {
+		overlap = 0
+	}
+	return float64(w.Previous)*overlap + float64(w.Current)
+}
+
+// Reset returns how long until the current window ends.
+func (w *RateLimitWindow) Reset(now time.Time) time.Duration {
+	return w.Start.Add(w.Length).Sub(now)
+}
+
+// RetryAfter returns how long the client has to wait before the estimate drops far
+// enough for another request to fit within limit, or 0 if it may make one now.
+func (w *RateLimitWindow) RetryAfter(now time.Time, limit int) time.Duration {
+	if w.Estimate(now)+1 <= float64(limit) {
+		return 0
+	}
+
+	// If the current window is already full on its own, nothing will fit until it has
+	// become the previous window.
+	spare := float64(limit - w.Current - 1)
+	if spare < 0 || w.Previous == 0 {
+		return w.Reset(now)
+	}
+
+	// Otherwise wait for enough of the previous window to slide out of view.
+	until := w.Start.Add(time.Duration((1 - spare/float64(w.Previous)) * float64(w.Length)))
+	return time.Duration(math.Max(0, float64(until.Sub(now))))
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type RateLimitModel struct {
+	DB *sql.DB
+}
+
+// Hit counts a request against key in the fixed window of the given length containing
+// the current time, and returns the counts for that window and the one before it.
+//
+// The window is worked out from the database's clock rather than the caller's, since
+// every instance of the API shares the counters and their clocks may not agree. The
+// returned Now is that clock's reading, for passing to the window's methods.
+func (m RateLimitModel) Hit(key string, length time.Duration) (*RateLimitWindow, error) {
+	w := RateLimitWindow{
+		Key:    key,
+		Length: length,
+	}
+
+	query := `
+		WITH clock AS (
+			SELECT NOW() AS now, to_timestamp(floor(extract(epoch FROM NOW()) / $2) * $2) AS window_start
+		), current AS (
+			INSERT INTO rate_limits (key, window_start, count)
+			SELECT $1, window_start, 1 FROM clock
+			ON CONFLICT (key, window_start) DO UPDATE
+			SET count = rate_limits.count + 1
+			RETURNING window_start, count
+		)
+		SELECT clock.now, current.window_start, current.count, COALESCE(previous.count, 0)
+		FROM clock
+		CROSS JOIN current
+		LEFT JOIN rate_limits AS previous
+			ON previous.key = $1 AND previous.window_start = current.window_start - make_interval(secs => $2)`
+
+	// This runs on every request, so it's given much less time than other queries. If
+	// the database is that slow the caller is better off falling back to local limits.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, length.Seconds()).Scan(&w.Now, &w.Start, &w.Current, &w.Previous)
+	if err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// DeleteExpired removes the counts for windows which started more than age ago, by the
+// database's clock.
+func (m RateLimitModel) DeleteExpired(age time.Duration) error {
+	query := `
+		DELETE FROM rate_limits
+		WHERE window_start < NOW() - make_interval(secs => $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, age.Seconds())
+	return err
+}
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitWindow(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	// Half way through a ten second window, so half of the previous window still counts.
+	now := start.Add(5 * time.Second)
+
+	tests := []struct {
+		name           string
+		w              RateLimitWindow
+		wantEstimate   float64
+		wantRetryAfter time.Duration
+	}{
+		{"empty", RateLimitWindow{}, 0, 0},
+		{"room for more", RateLimitWindow{Previous: 4, Current: 1}, 3, 0},
+		{"previous window sliding out", RateLimitWindow{Previous: 4, Current: 2}, 4, 2500 * time.Millisecond},
+		{"current window full", RateLimitWindow{Previous: 0, Current: 4}, 4, 5 * time.Second},
+		{"over the limit", RateLimitWindow{Previous: 2, Current: 9}, 10, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.w.Start = start
+			tt.w.Length = 10 * time.Second
+
+			if got := tt.w.Estimate(now); got != tt.wantEstimate {
+				t.Errorf("Estimate() = %v; want %v", got, tt.wantEstimate)
+			}
+			if got := tt.w.RetryAfter(now, 4); got != tt.wantRetryAfter {
+				t.Errorf("RetryAfter() = %v; want %v", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestHitUsesDatabaseClock(t *testing.T) {
+	rec := &recorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	RateLimitModel{DB: db}.Hit("ip:192.0.2.1", 2*time.Second)
+
+	if len(rec.statements) != 1 {
+		t.Fatalf("ran %d statements; want 1", len(rec.statements))
+	}
+	s := rec.statements[0]
+	if !strings.Contains(s.query, "floor(extract(epoch FROM NOW()) / $2)") {
+		t.Errorf("window isn't placed by the database's clock:\n%s", s.query)
+	}
+	for _, arg := range s.args {
+		if _, ok := arg.(time.Time); ok {
+			t.Errorf("args = %v; the caller's clock shouldn't be passed in", s.args)
+		}
+	}
+	if len(s.args) != 2 || s.args[0] != "ip:192.0.2.1" || s.args[1] != 2.0 {
+		t.Errorf("args = %v; want [ip:192.0.2.1 2]", s.args)
+	}
+}
@@ -0,0 +1,254 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"time"
+
+	"backend.delmesia/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// Constants for the token scopes. A token is only ever accepted for the scope it was
+// issued for.
+const (
+	ScopeActivation     = "activation"
+	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeAccountUnlock  = "account-unlock"
+)
+
+// Token holds the data for an individual token. Only the SHA-256 hash of the plaintext
+// is stored in the database; the plaintext itself is sent to the user and never kept.
+type Token struct {
+	ID        int64     `json:"-"`
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+}
+
+// Session describes an authentication token as shown to its owner, so they can
+// recognise their devices and revoke the ones they don't want any more.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
+}
+
+func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token := &Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl),
+		Scope:  scope,
+	}
+
+	// Fill a 16-byte slice with random bytes from the operating system's CSPRNG.
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode the random bytes to a base-32 string without padding, which gives a
+	// 26-character token such as "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU".
+	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token, nil
+}
+
+// ValidateTokenPlaintext checks that the plaintext token has been provided and is
+// exactly 26 bytes long.
+func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type TokenModel struct {
+	DB *sql.DB
+}
+
+// The New() method is a shortcut which creates a new Token struct and then inserts the
+// data in the tokens table.
+func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewSession creates an authentication token, recording the client's user agent and IP
+// address so the session can be identified later.
+func (m TokenModel) NewSession(userID int64, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = userAgent
+	token.IP = ip
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// The Insert() method adds the data for a specific token to the tokens table.
+func (m TokenModel) Insert(token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID)
+}
+
+// DeleteAllForUser deletes all tokens for a specific user and scope.
+func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+// GetSessionsForUser lists a user's unexpired authentication tokens, most recently
+// created first. currentID marks the session the request was made with, if any.
+func (m TokenModel) GetSessionsForUser(userID, currentID int64) ([]*Session, error) {
+	query := `
+		SELECT id, created_at, last_used_at, expiry, user_agent, ip
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		session.Current = session.ID == currentID
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSessionForUser revokes a single authentication token. If the user has no
+// session with that ID, ErrRecordNotFound is returned.
+func (m TokenModel) DeleteSessionForUser(id, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE id = $1 AND user_id = $2 AND scope = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteOtherSessionsForUser revokes every authentication token the user has except
+// keepID. Passing a keepID of 0 revokes them all.
+func (m TokenModel) DeleteOtherSessionsForUser(userID, keepID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND id <> $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, ScopeAuthentication, keepID)
+	return err
+}
+
+// TouchSessions records when a batch of sessions was last used, in a single statement.
+// It's meant to be called periodically with activity collected in memory, rather than
+// once per request.
+func (m TokenModel) TouchSessions(lastUsed map[int64]time.Time) error {
+	if len(lastUsed) == 0 {
+		return nil
+	}
+
+	// The timestamps are sent as RFC 3339 strings, which PostgreSQL casts back to
+	// timestamptz, since the driver has no native encoding for a []time.Time.
+	ids := make([]int64, 0, len(lastUsed))
+	times := make([]string, 0, len(lastUsed))
+	for id, t := range lastUsed {
+		ids = append(ids, id)
+		times = append(times, t.Format(time.RFC3339Nano))
+	}
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = GREATEST(tokens.last_used_at, activity.last_used_at)
+		FROM unnest($1::bigint[], $2::timestamptz[]) AS activity(id, last_used_at)
+		WHERE tokens.id = activity.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(ids), pq.Array(times))
+	return err
+}
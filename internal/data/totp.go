@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TOTP holds a user's two-factor authentication enrolment. It only takes effect once
+// Confirmed is true, i.e. once the user has proved their authenticator app works.
+type TOTP struct {
+	UserID       int64
+	CreatedAt    time.Time
+	Secret       []byte
+	Confirmed    bool
+	LastUsedStep uint64
+}
+
+// hashRecoveryCode normalises a recovery code and hashes it for storage. Recovery codes
+// are random and long enough that a fast hash is sufficient.
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hash[:]
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Enroll stores a new, unconfirmed secret and set of recovery codes for a user,
+// replacing any earlier enrolment that was never confirmed.
+func (m TOTPModel) Enroll(userID int64, secret []byte, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	// Deleting the old row also removes its recovery codes. A confirmed enrolment is
+	// never replaced here; the caller is expected to check for one first.
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1 AND NOT confirmed`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)`, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	hashes := make([][]byte, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_totp_recovery_codes (user_id, hash)
+		SELECT $1, unnest($2::bytea[])`, userID, pq.Array(hashes))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The Get() method returns a user's enrolment, or ErrRecordNotFound if they have never
+// enrolled.
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, created_at, secret, confirmed, last_used_step
+		FROM user_totp
+		WHERE user_id = $1`
+
+	var t TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.CreatedAt, &t.Secret, &t.Confirmed, &t.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// IsEnabled reports whether the user has a confirmed enrolment, i.e. whether logins
+// need a second factor.
+func (m TOTPModel) IsEnabled(userID int64) (bool, error) {
+	t, err := m.Get(userID)
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return t.Confirmed, nil
+}
+
+// UseStep records that the code for step has been accepted, and marks the enrolment as
+// confirmed. It returns false if a code for this step or a later one has already been
+// used, which is what stops a code being replayed, even by concurrent requests.
+func (m TOTPModel) UseStep(userID int64, step uint64) (bool, error) {
+	query := `
+		UPDATE user_totp
+		SET last_used_step = $2, confirmed = true
+		WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes. It returns false if the
+// code doesn't match any unused recovery code.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		DELETE FROM user_totp_recovery_codes
+		WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the query spans. It comes from the global provider, which is a no-op
+// unless the application has installed one.
+var tracer = otel.Tracer("backend.delmesia/internal/data")
+
+// sqlQueryer is satisfied by both *sql.DB and *sql.Tx.
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// queryer is satisfied by tracedQueryer, whether it wraps a *sql.DB or a *sql.Tx, so the
+// same queries can be run inside or outside a transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rows is the part of *sql.Rows that the models use.
+type rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}
+
+// tracedQueryer runs every statement in its own span. The span records the statement,
+// but never the argument values, which can hold personal data.
+type tracedQueryer struct {
+	q sqlQueryer
+}
+
+func (t tracedQueryer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	result, err := t.q.ExecContext(ctx, query, args...)
+	recordQueryError(span, err)
+	return result, err
+}
+
+// QueryContext leaves the span open until the rows are closed, since the results are
+// still being streamed from the database while they're read.
+func (t tracedQueryer) QueryContext(ctx context.Context, query string, args ...any) (rows, error) {
+	ctx, span := startQuerySpan(ctx, query)
+
+	r, err := t.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		recordQueryError(span, err)
+		span.End()
+		return nil, err
+	}
+
+	return &tracedRows{Rows: r, span: span}, nil
+}
+
+func (t tracedQueryer) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	row := t.q.QueryRowContext(ctx, query, args...)
+	recordQueryError(span, row.Err())
+	return row
+}
+
+// tracedRows ends the query's span when it's closed, recording any error met while
+// reading the rows.
+type tracedRows struct {
+	*sql.Rows
+	span  trace.Span
+	ended bool
+}
+
+func (r *tracedRows) Close() error {
+	err := r.Rows.Close()
+
+	if !r.ended {
+		r.ended = true
+		recordQueryError(r.span, errors.Join(r.Rows.Err(), err))
+		r.span.End()
+	}
+
+	return err
+}
+
+func startQuerySpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	// Collapsing the whitespace keeps the indented multi-line queries readable in trace
+	// viewers.
+	statement := strings.Join(strings.Fields(query), " ")
+
+	// Spans are named after the SQL operation, e.g. "SELECT", as the semantic conventions
+	// suggest when there's no single table to add.
+	name := "SQL"
+	if operation, _, _ := strings.Cut(statement, " "); operation != "" {
+		name = strings.ToUpper(operation)
+	}
+
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", statement),
+		),
+	)
+}
+
+// recordQueryError marks the span as failed. sql.ErrNoRows is an expected outcome rather
+// than a failure, so it's left alone.
+func recordQueryError(span trace.Span, err error) {
+	if err == nil || errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
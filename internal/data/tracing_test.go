@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMovieModelQueriesAreTraced(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+
+	original := tracer
+	tracer = provider.Tracer("test")
+	defer func() { tracer = original }()
+
+	for name, op := range movieOperations {
+		t.Run(name, func(t *testing.T) {
+			rec := &recorder{}
+			db := sql.OpenDB(rec)
+			defer db.Close()
+
+			ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+			op(MovieModel{DB: db}.ForOrganization(7).WithContext(ctx))
+			parent.End()
+
+			var children []sdktrace.ReadOnlySpan
+			for _, span := range spans.Ended() {
+				if span.Parent().SpanID() == parent.SpanContext().SpanID() {
+					children = append(children, span)
+				}
+			}
+
+			if len(children) != len(rec.statements) {
+				t.Fatalf("got %d query spans for %d statements", len(children), len(rec.statements))
+			}
+
+			for i, span := range children {
+				want := strings.Join(strings.Fields(rec.statements[i].query), " ")
+
+				var statement string
+				for _, attr := range span.Attributes() {
+					if attr.Key == "db.statement" {
+						statement = attr.Value.AsString()
+					}
+					// Argument values such as titles and external IDs must never
+					// end up in the trace.
+					for _, arg := range rec.statements[i].args {
+						if s, ok := arg.(string); ok && s != "" && strings.Contains(attr.Value.Emit(), s) {
+							t.Errorf("span attribute %s contains argument %q", attr.Key, s)
+						}
+					}
+				}
+				if statement != want {
+					t.Errorf("db.statement = %q; want %q", statement, want)
+				}
+				if op, _, _ := strings.Cut(want, " "); span.Name() != op {
+					t.Errorf("span name = %q; want %q", span.Name(), op)
+				}
+			}
+		})
+	}
+}
+
+func TestQuerySpanEndsWhenRowsAreClosed(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+
+	original := tracer
+	tracer = provider.Tracer("test")
+	defer func() { tracer = original }()
+
+	db := sql.OpenDB(&recorder{})
+	defer db.Close()
+
+	rows, err := tracedQueryer{db}.QueryContext(context.Background(), "SELECT id FROM movies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rows haven't been read yet, so the query isn't over.
+	if n := len(spans.Ended()); n != 0 {
+		t.Fatalf("%d spans ended before the rows were closed", n)
+	}
+
+	for rows.Next() {
+	}
+	rows.Close()
+	rows.Close()
+
+	if n := len(spans.Ended()); n != 1 {
+		t.Errorf("%d spans ended after the rows were closed; want 1", n)
+	}
+}
+
+func TestRecordQueryErrorIgnoresNoRows(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+
+	for _, err := range []error{sql.ErrNoRows, fmt.Errorf("get movie: %w", sql.ErrNoRows)} {
+		_, span := provider.Tracer("test").Start(context.Background(), "SELECT")
+		recordQueryError(span, err)
+		span.End()
+	}
+
+	for _, span := range spans.Ended() {
+		if span.Status().Code == codes.Error {
+			t.Errorf("span was marked as failed: %v", span.Status())
+		}
+	}
+}
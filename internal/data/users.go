@@ -0,0 +1,360 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"backend.delmesia/internal/validator"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrDuplicateEmail is returned when trying to register an email address which already
+// belongs to another user.
+var (
+	ErrDuplicateEmail = errors.New("duplicate email")
+)
+
+// AnonymousUser represents a client which hasn't authenticated.
+var AnonymousUser = &User{}
+
+// User represents an individual user. The password hash is never included in the JSON
+// output, and the version is used for optimistic locking just like on movies.
+type User struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Password  password  `json:"-"`
+	Activated bool      `json:"activated"`
+	Version   int       `json:"-"`
+}
+
+// IsAnonymous reports whether the user is the AnonymousUser.
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
+}
+
+// password holds both the plaintext and the hashed version of a user's password. The
+// plaintext is a pointer so that we can tell "not provided" apart from an empty string;
+// it is only ever populated when the user has supplied a new password.
+type password struct {
+	plaintext *string
+	hash      []byte
+}
+
+// Set calculates the bcrypt hash of a plaintext password, and stores both the hash and
+// the plaintext versions in the struct.
+func (p *password) Set(plaintextPassword string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	if err != nil {
+		return err
+	}
+
+	p.plaintext = &plaintextPassword
+	p.hash = hash
+
+	return nil
+}
+
+// Matches checks whether the provided plaintext password matches the hashed password
+// stored in the struct.
+func (p *password) Matches(plaintextPassword string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func ValidateEmail(v *validator.Validator, email string) {
+	v.Check(email != "", "email", "must be provided")
+	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+}
+
+func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
+	// bcrypt silently truncates anything past 72 bytes, so longer passwords are refused
+	// rather than being partly ignored.
+	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+}
+
+func ValidateUser(v *validator.Validator, user *User) {
+	v.Check(user.Name != "", "name", "must be provided")
+	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	ValidateEmail(v, user.Email)
+
+	// If the plaintext password is not nil, call the standalone
+	// ValidatePasswordPlaintext() helper.
+	if user.Password.plaintext != nil {
+		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+	}
+
+	// If the password hash is ever nil, this will be due to a logic error in our
+	// codebase (probably because we forgot to set a password for the user). It's a
+	// useful sanity check to include here, but it's not a problem with the data
+	// provided by the client. So rather than adding an error to the validation map we
+	// raise a panic instead.
+	if user.Password.hash == nil {
+		panic("missing password hash for user")
+	}
+}
+
+// A struct type which wraps a sql.DB connection pool.
+type UserModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method creates a new user record, filling in the system-generated ID,
+// created_at and version fields. If the email address is already taken,
+// ErrDuplicateEmail is returned.
+//
+// New users don't belong to any organization. They're added to one by its owners or
+// admins, or create their own, so that signing up doesn't open anyone's catalog to them.
+func (m UserModel) Insert(user *User) error {
+	query := `
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "users_email_key"):
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The Get() method retrieves a user by ID.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetByEmail retrieves the user with the given email address. Because the email column
+// is citext the comparison is case-insensitive.
+func (m UserModel) GetByEmail(email string) (*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE email = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// The Update() method writes a user back to the database, checking the version number
+// to avoid a race with other updates to the same user.
+func (m UserModel) Update(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return updateUser(ctx, m.DB, user)
+}
+
+// ResetPassword saves a user whose password has just been changed and, in the same
+// transaction, deletes all of their authentication and password-reset tokens and API
+// keys. A reset is the usual response to a compromised account, so anyone holding an
+// old session or a key minted with it is locked out, and the reset token can't be
+// reused. Machine clients need new keys afterwards.
+func (m UserModel) ResetPassword(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	err = updateUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = ANY($2)`
+
+	scopes := []string{ScopeAuthentication, ScopePasswordReset}
+
+	_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(scopes))
+	if err != nil {
+		return err
+	}
+
+	query = `
+		DELETE FROM api_keys
+		WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func updateUser(ctx context.Context, db queryRower, user *User) error {
+	query := `
+		UPDATE users
+		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	args := []any{
+		user.Name,
+		user.Email,
+		user.Password.hash,
+		user.Activated,
+		user.ID,
+		user.Version,
+	}
+
+	err := db.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "users_email_key"):
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetForToken retrieves the user a valid, unexpired token with the given scope was
+// issued to. If there is no such token, ErrRecordNotFound is returned.
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	user, _, err := m.getForToken(tokenScope, tokenPlaintext)
+	return user, err
+}
+
+// GetForSession is like GetForToken for authentication tokens, but also returns the
+// ID of the token, which identifies the session.
+func (m UserModel) GetForSession(tokenPlaintext string) (*User, int64, error) {
+	return m.getForToken(ScopeAuthentication, tokenPlaintext)
+}
+
+func (m UserModel) getForToken(tokenScope, tokenPlaintext string) (*User, int64, error) {
+	// Tokens are only stored as hashes, so hash the plaintext before looking it up.
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, tokens.id
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3`
+
+	// Note that tokenHash is an array, so it's converted to a slice for the driver.
+	args := []any{tokenHash[:], tokenScope, time.Now()}
+
+	var user User
+	var tokenID int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&tokenID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, 0, ErrRecordNotFound
+		default:
+			return nil, 0, err
+		}
+	}
+
+	return &user, tokenID, nil
+}
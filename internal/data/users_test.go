@@ -0,0 +1,57 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserInsertJoinsNoOrganization(t *testing.T) {
+	rec := &recorder{rows: map[string][]driver.Value{
+		"INSERT INTO users": {int64(5), time.Now(), int64(1)},
+	}}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	user := &User{Name: "Alice", Email: "alice@example.com"}
+	user.Password.hash = []byte("hash")
+
+	err := UserModel{DB: db}.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range rec.statements {
+		if strings.Contains(s.query, "organization_memberships") {
+			t.Errorf("registering added a membership:\n%s", s.query)
+		}
+	}
+}
+
+func TestResetPasswordRevokesAPIKeys(t *testing.T) {
+	rec := &recorder{rows: map[string][]driver.Value{
+		"UPDATE users": {int64(2)},
+	}}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+
+	user := &User{ID: 5, Name: "Alice", Email: "alice@example.com", Activated: true, Version: 1}
+	user.Password.hash = []byte("hash")
+
+	err := UserModel{DB: db}.ResetPassword(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range rec.statements {
+		if strings.Contains(s.query, "DELETE FROM api_keys") {
+			if len(s.args) != 1 || s.args[0] != int64(5) {
+				t.Errorf("args = %v; want [5]", s.args)
+			}
+			return
+		}
+	}
+	t.Error("API keys weren't deleted")
+}
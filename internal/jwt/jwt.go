@@ -0,0 +1,216 @@
+// Package jwt issues and verifies the signed JSON Web Tokens used for stateless
+// authentication. Only the small subset of RFC 7519 that the API needs is implemented:
+// compact serialization, EdDSA (Ed25519) and HS256 signatures, and the registered
+// sub/iss/aud/iat/nbf/exp claims.
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for any token which can't be trusted. The wrapped error
+// explains why, but clients shouldn't be told the details.
+var ErrInvalidToken = errors.New("jwt: invalid token")
+
+// leeway is how far clocks are allowed to disagree when checking exp and nbf.
+const leeway = 30 * time.Second
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Claims holds the registered claims carried by our tokens. Times are in seconds since
+// the Unix epoch, as required by the spec.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  Audience `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expiry    int64    `json:"exp"`
+}
+
+// Audience is the "aud" claim, which may be either a single string or an array of
+// strings. We always issue a single string.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return err
+		}
+		*a = Audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Manager signs and verifies tokens for a single issuer and audience.
+type Manager struct {
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	TTL      time.Duration
+
+	// Now returns the current time. It defaults to time.Now and exists so tests can
+	// control the clock.
+	Now func() time.Time
+}
+
+func (m *Manager) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// Sign issues a token for subject which expires after the manager's TTL, returning the
+// token and its expiry time.
+func (m *Manager) Sign(subject string) (string, time.Time, error) {
+	k := m.Keys.signing
+	if k == nil {
+		return "", time.Time{}, errors.New("jwt: no signing key configured")
+	}
+
+	now := m.now()
+	expiry := now.Add(m.TTL)
+
+	claims := Claims{
+		Subject:   subject,
+		Issuer:    m.Issuer,
+		Audience:  Audience{m.Audience},
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    expiry.Unix(),
+	}
+
+	h, err := json.Marshal(header{Algorithm: k.alg, Type: "JWT", KeyID: k.id})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	var sig []byte
+	switch k.alg {
+	case AlgEdDSA:
+		sig = ed25519.Sign(k.private, []byte(signingInput))
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), expiry, nil
+}
+
+// Verify checks the token's signature against the key named by its kid header, then
+// checks the issuer, audience and validity period. Any failure is reported as an error
+// wrapping ErrInvalidToken.
+func (m *Manager) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid("malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid("malformed header")
+	}
+	var h header
+	err = json.Unmarshal(rawHeader, &h)
+	if err != nil {
+		return nil, invalid("malformed header")
+	}
+
+	k, ok := m.Keys.keys[h.KeyID]
+	if !ok {
+		return nil, invalid("unknown key id %q", h.KeyID)
+	}
+	// The algorithm is fixed by the key, never by the token, so a token can't talk us
+	// into "none" or into treating a public key as an HMAC secret.
+	if h.Algorithm != k.alg {
+		return nil, invalid("algorithm %q does not match key %q", h.Algorithm, k.id)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	switch k.alg {
+	case AlgEdDSA:
+		ok = ed25519.Verify(k.public, signingInput, sig)
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signingInput)
+		ok = hmac.Equal(sig, mac.Sum(nil))
+	}
+	if !ok {
+		return nil, invalid("bad signature")
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, invalid("malformed claims")
+	}
+	var claims Claims
+	err = json.Unmarshal(rawClaims, &claims)
+	if err != nil {
+		return nil, invalid("malformed claims")
+	}
+
+	now := m.now()
+
+	switch {
+	case claims.Issuer != m.Issuer:
+		return nil, invalid("unexpected issuer %q", claims.Issuer)
+	case !claims.Audience.contains(m.Audience):
+		return nil, invalid("token not intended for audience %q", m.Audience)
+	case claims.Expiry == 0 || now.Add(-leeway).After(time.Unix(claims.Expiry, 0)):
+		return nil, invalid("token has expired")
+	case now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, invalid("token is not valid yet")
+	}
+
+	return &claims, nil
+}
+
+func (a Audience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,196 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T, ks *KeySet, now *time.Time) *Manager {
+	t.Helper()
+
+	return &Manager{
+		Keys:     ks,
+		Issuer:   "greenlight",
+		Audience: "greenlight-api",
+		TTL:      time.Hour,
+		Now:      func() time.Time { return *now },
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := NewKeySet()
+	if err := ks.AddEd25519("ed-1", private); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.AddHMAC("hmac-1", []byte(strings.Repeat("s", 32))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kid := range []string{"ed-1", "hmac-1"} {
+		t.Run(kid, func(t *testing.T) {
+			if err := ks.SetSigningKey(kid); err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Unix(1_700_000_000, 0)
+			m := newTestManager(t, ks, &now)
+
+			token, expiry, err := m.Sign("42")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !expiry.Equal(now.Add(time.Hour)) {
+				t.Errorf("expiry = %v; want %v", expiry, now.Add(time.Hour))
+			}
+
+			claims, err := m.Verify(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "42" {
+				t.Errorf("subject = %q; want %q", claims.Subject, "42")
+			}
+
+			// Just before expiry (allowing for leeway) the token is still good, and
+			// after that it isn't.
+			now = now.Add(time.Hour + leeway)
+			if _, err := m.Verify(token); err != nil {
+				t.Errorf("unexpected error at expiry: %v", err)
+			}
+			now = now.Add(time.Second)
+			if _, err := m.Verify(token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("expected expired token to be rejected; got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	ks := NewKeySet()
+	if err := ks.AddHMAC("hmac-1", []byte(strings.Repeat("s", 32))); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.SetSigningKey("hmac-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	m := newTestManager(t, ks, &now)
+
+	token, _, err := m.Sign("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	otherAudience := *m
+	otherAudience.Audience = "someone-else"
+
+	otherIssuer := *m
+	otherIssuer.Issuer = "someone-else"
+
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT","kid":"hmac-1"}`))
+
+	tests := []struct {
+		name  string
+		m     *Manager
+		token string
+	}{
+		{"tampered claims", m, parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1"}`)) + "." + parts[2]},
+		{"alg none", m, noneHeader + "." + parts[1] + "."},
+		{"wrong audience", &otherAudience, token},
+		{"wrong issuer", &otherIssuer, token},
+		{"not a jwt", m, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.m.Verify(tt.token)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("expected ErrInvalidToken; got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadKeySetRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	// The old key is kept around as a public key only, so it can still verify tokens
+	// it signed but can no longer sign new ones.
+	oldPublic, oldPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePEM(t, filepath.Join(dir, "2026-01.pem"), "PUBLIC KEY", must(x509.MarshalPKIXPublicKey(oldPublic)))
+	writePEM(t, filepath.Join(dir, "2026-07.pem"), "PRIVATE KEY", must(x509.MarshalPKCS8PrivateKey(newPrivate)))
+
+	ks, err := LoadKeySet(dir, "2026-07")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	m := newTestManager(t, ks, &now)
+
+	// Sign a token with the old key, as the previous deployment would have.
+	oldKS := NewKeySet()
+	if err := oldKS.AddEd25519("2026-01", oldPrivate); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldKS.SetSigningKey("2026-01"); err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _, err := newTestManager(t, oldKS, &now).Sign("7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Verify(oldToken); err != nil {
+		t.Errorf("token signed with the retired key should still verify: %v", err)
+	}
+
+	if err := ks.SetSigningKey("2026-01"); err == nil {
+		t.Error("expected a public-only key to be refused as the signing key")
+	}
+
+	jwks := ks.JWKS()
+	if len(jwks) != 2 || jwks[0].KeyID != "2026-01" || jwks[1].KeyID != "2026-07" {
+		t.Errorf("unexpected JWKS: %+v", jwks)
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func must(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,214 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Supported signing algorithms.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+// key is a single entry in a KeySet. Ed25519 keys loaded from a public key file can
+// only verify tokens; everything else can also sign.
+type key struct {
+	id      string
+	alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func (k *key) canSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+// KeySet holds every key that tokens may be verified with, and picks the one new tokens
+// are signed with. Keeping retired keys in the set lets tokens they signed carry on
+// validating until they expire, which is what makes rotation seamless.
+type KeySet struct {
+	keys    map[string]*key
+	signing *key
+}
+
+// NewKeySet returns an empty KeySet.
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]*key)}
+}
+
+// LoadKeySet reads every key file in dir. The file name without its extension is used
+// as the key ID (the "kid" header), and the extension decides the key type:
+//
+//   - .pem files hold an Ed25519 key, either a PKCS #8 "PRIVATE KEY" or, for keys that
+//     should only verify, a PKIX "PUBLIC KEY".
+//   - .hmac files hold a base64-encoded HMAC-SHA256 secret of at least 32 bytes.
+//
+// New tokens are signed with the key named by signingKID, which must be able to sign.
+func LoadKeySet(dir, signingKID string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := NewKeySet()
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		kid := strings.TrimSuffix(entry.Name(), ext)
+
+		contents, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		switch ext {
+		case ".pem":
+			err = ks.addPEM(kid, contents)
+		case ".hmac":
+			var secret []byte
+			secret, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+			if err == nil {
+				err = ks.AddHMAC(kid, secret)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwt: loading key %q: %w", entry.Name(), err)
+		}
+	}
+
+	err = ks.SetSigningKey(signingKID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) addPEM(kid string, contents []byte) error {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		private, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return errors.New("private key is not an Ed25519 key")
+		}
+		return ks.AddEd25519(kid, private)
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		public, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("public key is not an Ed25519 key")
+		}
+		return ks.AddEd25519PublicKey(kid, public)
+	default:
+		return fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+func (ks *KeySet) add(k *key) error {
+	if k.id == "" {
+		return errors.New("jwt: key id must not be empty")
+	}
+	if _, exists := ks.keys[k.id]; exists {
+		return fmt.Errorf("jwt: duplicate key id %q", k.id)
+	}
+	ks.keys[k.id] = k
+	return nil
+}
+
+// AddHMAC adds an HMAC-SHA256 secret. Secrets shorter than 32 bytes are refused.
+func (ks *KeySet) AddHMAC(kid string, secret []byte) error {
+	if len(secret) < 32 {
+		return errors.New("jwt: HMAC secret must be at least 32 bytes long")
+	}
+	return ks.add(&key{id: kid, alg: AlgHS256, secret: secret})
+}
+
+// AddEd25519 adds an Ed25519 private key, which can both sign and verify.
+func (ks *KeySet) AddEd25519(kid string, private ed25519.PrivateKey) error {
+	return ks.add(&key{
+		id:      kid,
+		alg:     AlgEdDSA,
+		private: private,
+		public:  private.Public().(ed25519.PublicKey),
+	})
+}
+
+// AddEd25519PublicKey adds an Ed25519 public key, which can only verify.
+func (ks *KeySet) AddEd25519PublicKey(kid string, public ed25519.PublicKey) error {
+	return ks.add(&key{id: kid, alg: AlgEdDSA, public: public})
+}
+
+// SetSigningKey chooses the key that new tokens are signed with.
+func (ks *KeySet) SetSigningKey(kid string) error {
+	k, ok := ks.keys[kid]
+	if !ok {
+		return fmt.Errorf("jwt: signing key %q not found", kid)
+	}
+	if !k.canSign() {
+		return fmt.Errorf("jwt: key %q cannot be used for signing", kid)
+	}
+	ks.signing = k
+	return nil
+}
+
+// JWK is the JSON Web Key representation of a public key, as described in RFC 8037.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JWKS returns the public keys in the set, sorted by key ID, so that other services can
+// verify our tokens. HMAC secrets are symmetric and are never included.
+func (ks *KeySet) JWKS() []JWK {
+	jwks := []JWK{}
+
+	for _, k := range ks.keys {
+		if k.public == nil {
+			continue
+		}
+		jwks = append(jwks, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(k.public),
+			KeyID:     k.id,
+			Algorithm: AlgEdDSA,
+			Use:       "sig",
+		})
+	}
+
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].KeyID < jwks[j].KeyID })
+
+	return jwks
+}
@@ -0,0 +1,219 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"embed"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"text/template"
+	"time"
+
+	htmltemplate "html/template"
+)
+
+// templateFS holds the email templates. The comment directive below embeds the contents
+// of the ./templates directory into the binary at build time.
+//
+//go:embed "templates"
+var templateFS embed.FS
+
+// Mailer sends templated emails through an SMTP server.
+type Mailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	sender   string
+	timeout  time.Duration
+}
+
+// New returns a Mailer which delivers through the SMTP server at host:port. If username
+// is empty no authentication is attempted, which is handy for local development
+// servers. sender is the From address, e.g. "Greenlight <no-reply@greenlight.example>".
+func New(host string, port int, username, password, sender string) Mailer {
+	return Mailer{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		sender:   sender,
+		timeout:  5 * time.Second,
+	}
+}
+
+// Send renders the "subject", "plainBody" and "htmlBody" templates from templateFile
+// with data, and emails the result to recipient as a multipart/alternative message.
+// Delivery is attempted up to three times before giving up.
+func (m Mailer) Send(recipient, templateFile string, data any) error {
+	msg, err := m.render(recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = m.deliver(recipient, msg)
+		// If everything worked, return nil.
+		if err == nil {
+			return nil
+		}
+
+		// If it didn't work, sleep for a short time and retry.
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return err
+}
+
+// render builds the complete message, headers included.
+func (m Mailer) render(recipient, templateFile string, data any) ([]byte, error) {
+	// The plaintext parts are rendered with text/template and the HTML body with
+	// html/template, so that values interpolated into the HTML are escaped.
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	plainBody := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlTmpl, err := htmltemplate.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(bytes.Buffer)
+	body := multipart.NewWriter(msg)
+
+	fmt.Fprintf(msg, "From: %s\r\n", m.sender)
+	fmt.Fprintf(msg, "To: %s\r\n", recipient)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", body.Boundary())
+
+	// The preferred alternative goes last, so the plaintext part comes first.
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=UTF-8", plainBody.Bytes()},
+		{"text/html; charset=UTF-8", htmlBody.Bytes()},
+	} {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		w, err := body.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		_, err = qp.Write(part.content)
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+// deliver performs a single SMTP transaction. STARTTLS is used whenever the server
+// offers it.
+func (m Mailer) deliver(recipient string, msg []byte) error {
+	from, err := mail.ParseAddress(m.sender)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(m.host, strconv.Itoa(m.port)), m.timeout)
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(m.timeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: m.host})
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.username != "" {
+		err = c.Auth(smtp.PlainAuth("", m.username, m.password, m.host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(to.Address)
+	if err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
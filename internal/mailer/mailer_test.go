@@ -0,0 +1,182 @@
+package mailer
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts a single SMTP session on a local port and passes the envelope
+// and message data it received back on a channel.
+type fakeSMTPServer struct {
+	listener net.Listener
+	received chan fakeMessage
+}
+
+type fakeMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakeSMTPServer{listener: ln, received: make(chan fakeMessage, 1)}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	var msg fakeMessage
+
+	tp.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			// Drop any ESMTP parameters such as BODY=8BITMIME after the address.
+			from, _, _ := strings.Cut(strings.TrimPrefix(arg, "FROM:"), " ")
+			msg.from = strings.Trim(from, "<>")
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			s.received <- msg
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+
+	m := New("127.0.0.1", srv.port(), "", "", "Greenlight <no-reply@greenlight.example>")
+
+	err := m.Send("alice@example.com", "user_welcome.tmpl", map[string]any{
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"userID":          42,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-srv.received
+
+	if got.from != "no-reply@greenlight.example" {
+		t.Errorf("MAIL FROM = %q", got.from)
+	}
+	if len(got.to) != 1 || got.to[0] != "alice@example.com" {
+		t.Errorf("RCPT TO = %q", got.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject := msg.Header.Get("Subject"); subject != "Welcome to Greenlight!" {
+		t.Errorf("Subject = %q", subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q; want multipart/alternative", mediaType)
+	}
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+
+	for _, contentType := range []string{"text/plain", "text/html"} {
+		body, ok := parts[contentType]
+		if !ok {
+			t.Errorf("missing %s part", contentType)
+			continue
+		}
+		if !strings.Contains(body, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU") {
+			t.Errorf("%s part does not contain the activation token", contentType)
+		}
+		if !strings.Contains(body, "user ID number is 42") {
+			t.Errorf("%s part does not contain the user ID", contentType)
+		}
+	}
+}
+
+func TestSendUnreachableServer(t *testing.T) {
+	// Grab a free port and close it again, so nothing is listening there.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	m := New("127.0.0.1", port, "", "", "no-reply@greenlight.example")
+
+	err = m.Send("alice@example.com", "user_welcome.tmpl", map[string]any{})
+	if err == nil {
+		t.Fatal("expected an error sending to an unreachable server")
+	}
+}
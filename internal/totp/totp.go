@@ -0,0 +1,149 @@
+// Package totp implements time-based one-time passwords as described in RFC 6238, using
+// the defaults understood by every authenticator app: HMAC-SHA1, 6 digits and a 30
+// second step. Times are always passed in, so callers (and tests) control the clock.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is the length of a generated code.
+	Digits = 6
+	// Period is how long each code is valid for.
+	Period = 30 * time.Second
+	// SecretSize is the length of generated secrets in bytes, as recommended by
+	// RFC 4226.
+	SecretSize = 20
+)
+
+// Encoding is the base32 alphabet used for secrets in otpauth:// URIs.
+var Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random shared secret.
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// URI returns the otpauth:// URI which authenticator apps read (usually from a QR
+// code) to enrol an account.
+func URI(issuer, account string, secret []byte) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	params := url.Values{}
+	params.Set("secret", Encoding.EncodeToString(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period.Seconds())))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(Period.Seconds())
+}
+
+// Code returns the code for the time step containing t.
+func Code(secret []byte, t time.Time) string {
+	return hotp(secret, Step(t), Digits)
+}
+
+// Validate checks code against the time steps within skew steps either side of t, to
+// allow for clocks that disagree a little. To stop a code being replayed, only steps
+// after lastStep are considered. On success the matching step is returned, and the
+// caller should record it as the new lastStep.
+func Validate(secret []byte, code string, t time.Time, skew int, lastStep uint64) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(t)
+
+	for i := -skew; i <= skew; i++ {
+		step := current + uint64(i)
+		// Guard against wrapping around below zero.
+		if i < 0 && uint64(-i) > current {
+			continue
+		}
+		if step <= lastStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, step, Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// hotp computes an HMAC-based one-time password (RFC 4226).
+func hotp(secret []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation: the low 4 bits of the last byte pick where to read a 31-bit
+	// integer from.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// GenerateRecoveryCodes returns n single-use recovery codes, such as "7k2q-9xbm-3hfp",
+// for when the user has lost their authenticator.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+	codes := make([]string, n)
+
+	for i := range codes {
+		randomBytes := make([]byte, 12)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		var sb strings.Builder
+		for j, b := range randomBytes {
+			if j > 0 && j%4 == 0 {
+				sb.WriteByte('-')
+			}
+			// The alphabet has 31 characters, so taking the byte modulo 31 is very
+			// slightly biased, which is irrelevant at 12 characters of entropy.
+			sb.WriteByte(alphabet[int(b)%len(alphabet)])
+		}
+		codes[i] = sb.String()
+	}
+
+	return codes, nil
+}
@@ -0,0 +1,113 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The shared secret used by the test vectors in RFC 4226 and RFC 6238.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226, Appendix D.
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range want {
+		if got := hotp(rfcSecret, uint64(counter), 6); got != code {
+			t.Errorf("hotp(counter=%d) = %s; want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238, Appendix B (SHA1 only).
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		if got := hotp(rfcSecret, Step(time.Unix(tt.unix, 0)), 8); got != tt.want {
+			t.Errorf("TOTP at %d = %s; want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1_700_000_015, 0)
+	code := Code(rfcSecret, now)
+
+	step, ok := Validate(rfcSecret, code, now, 1, 0)
+	if !ok || step != Step(now) {
+		t.Fatalf("Validate() = %d, %v; want %d, true", step, ok, Step(now))
+	}
+
+	// The same code can't be used twice.
+	if _, ok := Validate(rfcSecret, code, now, 1, step); ok {
+		t.Error("expected a replayed code to be rejected")
+	}
+
+	// A code from the previous step is accepted with a skew of 1, but not 0.
+	later := now.Add(Period)
+	if _, ok := Validate(rfcSecret, code, later, 1, 0); !ok {
+		t.Error("expected the previous step's code to be accepted with skew 1")
+	}
+	if _, ok := Validate(rfcSecret, code, later, 0, 0); ok {
+		t.Error("expected the previous step's code to be rejected with skew 0")
+	}
+
+	// Two steps out is too far.
+	if _, ok := Validate(rfcSecret, code, now.Add(2*Period), 1, 0); ok {
+		t.Error("expected a code two steps old to be rejected")
+	}
+
+	if _, ok := Validate(rfcSecret, "12345", now, 1, 0); ok {
+		t.Error("expected a short code to be rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Greenlight", "alice@example.com", rfcSecret)
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("unexpected URI %q", uri)
+	}
+	if u.Path != "/Greenlight:alice@example.com" {
+		t.Errorf("label = %q", u.Path)
+	}
+	if got := u.Query().Get("secret"); got != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Errorf("secret = %q", got)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 14 || strings.Count(code, "-") != 2 {
+			t.Errorf("unexpected recovery code format %q", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate recovery code %q", code)
+		}
+		seen[code] = true
+	}
+}
@@ -0,0 +1,24 @@
+package validator
+
+import "testing"
+
+func TestEmailRX(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@example.com", true},
+		{"alice.smith+films@mail.example.co.uk", true},
+		{"bob@localhost", true},
+		{"alice@example. com", false},
+		{"alice@.example.com", false},
+		{"alice.example.com", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := Matches(tt.email, EmailRX); got != tt.want {
+			t.Errorf("Matches(%q, EmailRX) = %v; want %v", tt.email, got, tt.want)
+		}
+	}
+}
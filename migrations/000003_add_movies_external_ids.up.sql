@@ -0,0 +1,7 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS imdb_id text;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS tmdb_id text;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS eidr_id text;
+
+ALTER TABLE movies ADD CONSTRAINT movies_imdb_id_key UNIQUE (imdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_tmdb_id_key UNIQUE (tmdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_eidr_id_key UNIQUE (eidr_id);
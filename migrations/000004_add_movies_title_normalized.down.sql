@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS movies_year_title_normalized_idx;
+
+ALTER TABLE movies DROP COLUMN IF EXISTS title_normalized;
@@ -0,0 +1,4 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS title_normalized text
+    GENERATED ALWAYS AS (btrim(regexp_replace(lower(title), '[^[:alnum:]]+', ' ', 'g'))) STORED;
+
+CREATE INDEX IF NOT EXISTS movies_year_title_normalized_idx ON movies (year, title_normalized);
@@ -0,0 +1,3 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS movies_title_normalized_trgm_idx ON movies USING GIN (title_normalized gin_trgm_ops);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS movie_aliases (
+    alias_id bigint PRIMARY KEY,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS movie_aliases_movie_id_idx ON movie_aliases (movie_id);
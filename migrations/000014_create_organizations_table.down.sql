@@ -0,0 +1,14 @@
+DROP INDEX IF EXISTS movies_organization_id_year_title_normalized_idx;
+CREATE INDEX IF NOT EXISTS movies_year_title_normalized_idx ON movies (year, title_normalized);
+
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_imdb_id_key;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_tmdb_id_key;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_eidr_id_key;
+ALTER TABLE movies ADD CONSTRAINT movies_imdb_id_key UNIQUE (imdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_tmdb_id_key UNIQUE (tmdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_eidr_id_key UNIQUE (eidr_id);
+
+ALTER TABLE movies DROP COLUMN IF EXISTS organization_id;
+
+DROP TABLE IF EXISTS organization_memberships;
+DROP TABLE IF EXISTS organizations;
@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    slug citext UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS organization_memberships (
+    organization_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role text NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS organization_memberships_user_id_idx ON organization_memberships (user_id);
+
+-- Existing movies are moved into a default organization, which every existing user
+-- joins, so the column can be made NOT NULL straight away and nobody loses access.
+INSERT INTO organizations (name, slug) VALUES ('Default', 'default') ON CONFLICT DO NOTHING;
+
+INSERT INTO organization_memberships (organization_id, user_id, role)
+SELECT organizations.id, users.id, 'member' FROM organizations, users WHERE organizations.slug = 'default'
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS organization_id bigint REFERENCES organizations ON DELETE CASCADE;
+UPDATE movies SET organization_id = (SELECT id FROM organizations WHERE slug = 'default') WHERE organization_id IS NULL;
+ALTER TABLE movies ALTER COLUMN organization_id SET NOT NULL;
+
+-- External IDs only need to be unique within a catalog. The constraint names are kept so
+-- that duplicate errors are still recognised.
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_imdb_id_key;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_tmdb_id_key;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_eidr_id_key;
+ALTER TABLE movies ADD CONSTRAINT movies_imdb_id_key UNIQUE (organization_id, imdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_tmdb_id_key UNIQUE (organization_id, tmdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_eidr_id_key UNIQUE (organization_id, eidr_id);
+
+DROP INDEX IF EXISTS movies_year_title_normalized_idx;
+CREATE INDEX IF NOT EXISTS movies_organization_id_year_title_normalized_idx ON movies (organization_id, year, title_normalized);
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'movies:contribute';
+
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
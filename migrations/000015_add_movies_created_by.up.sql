@@ -0,0 +1,6 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+-- Contributors can add movies and edit the ones they created, but unlike holders of
+-- movies:write they can't touch anyone else's.
+INSERT INTO permissions (code)
+VALUES ('movies:contribute');
@@ -0,0 +1,10 @@
+-- Counters are cheap to lose, so the table is unlogged to keep the write load down. A
+-- crash just resets everyone's limits.
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key text NOT NULL,
+    window_start timestamp with time zone NOT NULL,
+    count integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (key, window_start)
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_window_start_idx ON rate_limits (window_start);
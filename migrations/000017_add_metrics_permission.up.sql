@@ -0,0 +1,4 @@
+-- Operational endpoints served on the main port, such as /metrics when there's no
+-- separate admin listener, require this permission.
+INSERT INTO permissions (code)
+VALUES ('metrics:read');